@@ -0,0 +1,195 @@
+// lru-sim replays access traces against cache configurations and reports hit ratio for each of them.
+//
+// Usage:
+//
+//	lru-sim -trace trace.txt -format plain -capacities 1000,10000,100000
+//	lru-sim -trace trace.csv -format csv -config configs.json -output csv
+//
+// Configurations file is a JSON array of {"name": "...", "config": {...}} objects,
+// where config is lru.Config. TTL is set in nanoseconds.
+// When no configurations file is given, every eviction policy is simulated with no TTL.
+//
+// When the trace has timestamps(csv and lru formats), the cache clock follows them, so TTL is measured in trace time
+// and the configured clock is ignored. Otherwise TTL is measured by the wall clock during the replay.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+
+	"github.com/pavel-krush/cache/v2/lru"
+)
+
+func main() {
+	var (
+		tracePath  = flag.String("trace", "-", "trace file path, \"-\" for stdin")
+		format     = flag.String("format", formatPlain, "trace format: plain, arc, lirs, csv or lru")
+		configPath = flag.String("config", "", "cache configurations file")
+		capacities = flag.String("capacities", "", "comma separated list of capacities to sweep, overrides configured capacity")
+		output     = flag.String("output", "table", "output format: table or csv")
+	)
+	flag.Parse()
+
+	if err := run(*tracePath, *format, *configPath, *capacities, *output, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "lru-sim: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(tracePath, format, configPath, capacitiesList, output string, w io.Writer) error {
+	trace, err := loadTrace(tracePath, format)
+	if err != nil {
+		return err
+	}
+
+	configs, err := loadConfigs(configPath)
+	if err != nil {
+		return err
+	}
+
+	capacities, err := parseCapacities(capacitiesList)
+	if err != nil {
+		return err
+	}
+
+	var results []result
+	for _, cfg := range configs {
+		if len(capacities) == 0 {
+			if err := cfg.Config.Validate(); err != nil {
+				return errors.Wrapf(err, "config \"%s\"", cfg.Name)
+			}
+			results = append(results, simulate(trace, cfg.Name, cfg.Config))
+			continue
+		}
+
+		for _, capacity := range capacities {
+			c := cfg.Config
+			c.Capacity = capacity
+			if err := c.Validate(); err != nil {
+				return errors.Wrapf(err, "config \"%s\"", cfg.Name)
+			}
+			results = append(results, simulate(trace, cfg.Name, c))
+		}
+	}
+
+	switch output {
+	case "table":
+		return writeTable(w, results)
+	case "csv":
+		return writeCSV(w, results)
+	default:
+		return errors.Errorf("unknown output format \"%s\"", output)
+	}
+}
+
+func loadTrace(path, format string) ([]access, error) {
+	if path == "-" {
+		return readTrace(os.Stdin, format)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open trace")
+	}
+	defer f.Close()
+
+	return readTrace(f, format)
+}
+
+func loadConfigs(path string) ([]namedConfig, error) {
+	if path == "" {
+		return []namedConfig{
+			{Name: "lru", Config: lru.Config{Capacity: 1000}},
+			{Name: "segmented", Config: lru.Config{Capacity: 1000, Policy: &lru.PolicyConfig{
+				Segmented: &lru.PolicyConfigSegmented{ProtectedRatio: 0.8},
+			}}},
+			{Name: "second-chance", Config: lru.Config{Capacity: 1000, Policy: &lru.PolicyConfig{
+				SecondChance: &lru.PolicyConfigSecondChance{},
+			}}},
+		}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read configs")
+	}
+
+	var ret []namedConfig
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, errors.Wrap(err, "parse configs")
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.New("no configs found")
+	}
+
+	return ret, nil
+}
+
+func parseCapacities(list string) ([]int, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	var ret []int
+	for _, s := range strings.Split(list, ",") {
+		capacity, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad capacity \"%s\"", s)
+		}
+		ret = append(ret, capacity)
+	}
+
+	return ret, nil
+}
+
+var header = []string{"config", "capacity", "requests", "hits", "misses", "hit_ratio", "evictions", "expirations"}
+
+func row(r result) []string {
+	return []string{
+		r.name,
+		strconv.Itoa(r.capacity),
+		strconv.Itoa(r.requests),
+		strconv.Itoa(r.hits),
+		strconv.Itoa(r.misses),
+		strconv.FormatFloat(r.hitRatio(), 'f', 4, 64),
+		strconv.Itoa(r.evictions),
+		strconv.Itoa(r.expirations),
+	}
+}
+
+func writeTable(w io.Writer, results []result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+	for _, r := range results {
+		fmt.Fprintln(tw, strings.Join(row(r), "\t")+"\t")
+	}
+
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, results []result) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if err := cw.Write(row(r)); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pavel-krush/cache/v2/lru"
+	"github.com/pavel-krush/cache/v2/lru/lrutest"
+)
+
+// namedConfig is a cache configuration under test
+type namedConfig struct {
+	Name   string     `json:"name"`
+	Config lru.Config `json:"config"`
+}
+
+// result is the outcome of replaying a trace against a single cache configuration
+type result struct {
+	name        string
+	capacity    int
+	requests    int
+	hits        int
+	misses      int
+	evictions   int
+	expirations int
+}
+
+func (r result) hitRatio() float64 {
+	if r.requests == 0 {
+		return 0
+	}
+
+	return float64(r.hits) / float64(r.requests)
+}
+
+// simulate replays the trace against a cache built from the config.
+// Every request is a read, missed keys are written to the cache like a read-through cache does.
+// When the trace has timestamps, the cache clock follows them, otherwise TTL is measured by the wall clock.
+func simulate(trace []access, name string, cfg lru.Config) result {
+	ret := result{name: name, capacity: cfg.Capacity}
+
+	// simulated caches must not export anything
+	cfg.Metrics = nil
+
+	var clock *lrutest.FakeClock
+	if start := firstTimestamp(trace); !start.IsZero() {
+		clock = lrutest.NewFakeClock(start)
+		// the trace clock replaces the configured one
+		cfg.Clock = nil
+	}
+
+	builder := lru.NewFromConfig(&cfg).
+		WithEvictCallback(func(string) { ret.evictions++ }).
+		WithExpireCallback(func(string) { ret.expirations++ })
+	if clock != nil {
+		builder = builder.WithClock(clock)
+	}
+
+	cache := builder.Build()
+	defer cache.Destroy()
+
+	for i := range trace {
+		ret.requests++
+
+		if clock != nil && trace[i].at.After(clock.Now()) {
+			clock.Advance(trace[i].at.Sub(clock.Now()))
+		}
+
+		if _, found := cache.Get(trace[i].key); found {
+			ret.hits++
+			continue
+		}
+
+		ret.misses++
+		cache.Set(trace[i].key, struct{}{})
+	}
+
+	return ret
+}
+
+// firstTimestamp returns the time of the first timestamped request or zero time
+func firstTimestamp(trace []access) time.Time {
+	for i := range trace {
+		if !trace[i].at.IsZero() {
+			return trace[i].at
+		}
+	}
+
+	return time.Time{}
+}
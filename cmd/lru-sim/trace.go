@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/pavel-krush/cache/v2/lru/trace"
+)
+
+// access is a single request from the trace
+type access struct {
+	key string
+	at  time.Time // zero when the trace format has no timestamps
+}
+
+const (
+	formatPlain = "plain"
+	formatARC   = "arc"
+	formatLIRS  = "lirs"
+	formatCSV   = "csv"
+	formatLRU   = "lru"
+)
+
+// readTrace reads the whole trace in given format
+func readTrace(r io.Reader, format string) ([]access, error) {
+	if format == formatLRU {
+		return readRecordedTrace(r)
+	}
+
+	var parseLine func(line string, lineNo int, out []access) ([]access, error)
+
+	switch format {
+	case formatPlain:
+		parseLine = parsePlainLine
+	case formatARC:
+		parseLine = parseARCLine
+	case formatLIRS:
+		parseLine = parseLIRSLine
+	case formatCSV:
+		parseLine = parseCSVLine
+	default:
+		return nil, errors.Errorf("unknown trace format \"%s\"", format)
+	}
+
+	var ret []access
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var err error
+		ret, err = parseLine(line, lineNo, ret)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNo)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read trace")
+	}
+
+	return ret, nil
+}
+
+// readRecordedTrace reads Get requests of a trace written by lru.Builder.WithTraceRecorder
+func readRecordedTrace(r io.Reader) ([]access, error) {
+	var ret []access
+
+	tr := trace.NewReader(r)
+	for {
+		record, err := tr.Read()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read trace")
+		}
+
+		if record.Op != trace.OpGet {
+			continue
+		}
+
+		ret = append(ret, access{key: strconv.FormatUint(record.KeyHash, 16), at: record.Time})
+	}
+}
+
+// parsePlainLine parses a key per line
+func parsePlainLine(line string, _ int, out []access) ([]access, error) {
+	return append(out, access{key: line}), nil
+}
+
+// parseARCLine parses a line of ARC trace: "<start block> <number of blocks> <ignored> <request number>".
+// Each line is expanded into requests for blocks start..start+number-1
+func parseARCLine(line string, _ int, out []access) ([]access, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("expected at least two fields")
+	}
+
+	start, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "start block")
+	}
+
+	count, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "number of blocks")
+	}
+
+	for i := int64(0); i < count; i++ {
+		out = append(out, access{key: strconv.FormatInt(start+i, 10)})
+	}
+
+	return out, nil
+}
+
+// parseLIRSLine parses a line of LIRS trace: a block number per line, "*" lines are separators
+func parseLIRSLine(line string, _ int, out []access) ([]access, error) {
+	if line == "*" {
+		return out, nil
+	}
+
+	if _, err := strconv.ParseInt(line, 10, 64); err != nil {
+		return nil, errors.Wrap(err, "block number")
+	}
+
+	return append(out, access{key: line}), nil
+}
+
+// parseCSVLine parses a line of "<timestamp>,<key>[,...]" trace.
+// Timestamp is either unix time in seconds with optional fraction or RFC3339.
+// The first line is treated as a header when its timestamp can't be parsed
+func parseCSVLine(line string, lineNo int, out []access) ([]access, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 2 {
+		return nil, errors.New("expected at least two fields")
+	}
+
+	at, err := parseTimestamp(strings.TrimSpace(fields[0]))
+	if err != nil {
+		if len(out) == 0 && lineNo == 1 {
+			return out, nil
+		}
+		return nil, err
+	}
+
+	return append(out, access{key: strings.TrimSpace(fields[1]), at: at}), nil
+}
+
+func parseTimestamp(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := int64(seconds)
+		nsec := int64((seconds - float64(sec)) * float64(time.Second))
+		return time.Unix(sec, nsec), nil
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("bad timestamp \"%s\"", s)
+	}
+
+	return at, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_readTrace(t *testing.T) {
+	tests := []struct {
+		format string
+		input  string
+		keys   []string
+	}{
+		{formatPlain, "a\nb\n\na\n", []string{"a", "b", "a"}},
+		{formatARC, "10 3 0 1\n5 1 0 2\n", []string{"10", "11", "12", "5"}},
+		{formatLIRS, "1\n*\n2\n1\n", []string{"1", "2", "1"}},
+		{formatCSV, "ts,key\n1600000000,a\n1600000000.5,b\n", []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		trace, err := readTrace(strings.NewReader(tt.input), tt.format)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.format, err)
+			continue
+		}
+
+		if len(trace) != len(tt.keys) {
+			t.Errorf("%s: expected %d requests, got %d", tt.format, len(tt.keys), len(trace))
+			continue
+		}
+
+		for i := range tt.keys {
+			if trace[i].key != tt.keys[i] {
+				t.Errorf("%s: expected key \"%s\" at %d, got \"%s\"", tt.format, tt.keys[i], i, trace[i].key)
+			}
+		}
+	}
+}
+
+func Test_readTrace_csv_timestamps(t *testing.T) {
+	trace, err := readTrace(strings.NewReader("1600000000.5,a\n2020-09-13T12:26:40Z,b\n"), formatCSV)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !trace[0].at.Equal(time.Unix(1600000000, int64(time.Second/2))) {
+		t.Errorf("unexpected timestamp %s", trace[0].at)
+	}
+
+	if !trace[1].at.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("unexpected timestamp %s", trace[1].at)
+	}
+}
+
+func Test_simulate(t *testing.T) {
+	var trace []access
+	for i := 0; i < 3; i++ {
+		for _, k := range []string{"a", "b", "c"} {
+			trace = append(trace, access{key: k})
+		}
+	}
+
+	configs, _ := loadConfigs("")
+	for _, cfg := range configs {
+		cfg.Config.Capacity = 2
+		r := simulate(trace, cfg.Name, cfg.Config)
+		if r.requests != len(trace) || r.hits+r.misses != r.requests {
+			t.Errorf("%s: inconsistent result %+v", cfg.Name, r)
+		}
+	}
+}
+
+func Test_simulate_trace_time(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+
+	// "a" is requested again after its TTL in trace time
+	trace := []access{
+		{key: "a", at: start},
+		{key: "a", at: start.Add(time.Second)},
+		{key: "a", at: start.Add(time.Minute)},
+	}
+
+	configs, _ := loadConfigs("")
+	for _, cfg := range configs {
+		cfg.Config.TTL = time.Second * 10
+		r := simulate(trace, cfg.Name, cfg.Config)
+		if r.hits != 1 || r.misses != 2 {
+			t.Errorf("%s: expected the key expired in trace time, got %+v", cfg.Name, r)
+		}
+	}
+}
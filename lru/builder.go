@@ -1,28 +1,54 @@
 package lru
 
 import (
+	"io"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// defaultMaxPinnedRatio is the share of the capacity that can be pinned by default
+const defaultMaxPinnedRatio = 0.1
+
 type Builder struct {
-	optCapacity        *optionCapacity
-	optTTL             *optionTTL
-	optSync            *optionSync
-	optMetrics         *optionMetrics
-	optDiscreteClock   *optionDiscreteClock
-	optSetCallbacks    []*optionSetCallback
-	optDeleteCallbacks []*optionDeleteCallback
-	optEvictCallbacks  []*optionEvictCallback
-	optExpireCallbacks []*optionExpireCallback
+	optCapacity          *optionCapacity
+	optTTL               *optionTTL
+	optSync              *optionSync
+	optConcurrentReads   *optionConcurrentReads
+	optMetrics           *optionMetrics
+	optMetricsRegisterer *optionMetricsRegisterer
+	optCollector         *optionCollector
+	optLatency           *optionLatency
+	optDiscreteClock     *optionDiscreteClock
+	optClock             *optionClock
+	optSegmented         *optionSegmented
+	optSecondChance      *optionSecondChance
+	optTraceRecorder     *optionTraceRecorder
+	optMaxPinned         *optionMaxPinned
+	optPriorities        *optionPriorities
+	optPrefixIndex       *optionPrefixIndex
+	optMemory            *optionMemoryController
+	optHotKeys           *optionHotKeys
+	optPinnedExpire      *optionPinnedExpiration
+	optSetCallbacks      []*optionSetCallback
+	optDeleteCallbacks   []*optionDeleteCallback
+	optEvictCallbacks    []*optionEvictCallback
+	optExpireCallbacks   []*optionExpireCallback
+
+	// err is the first error of option setters, it's returned by BuildE
+	err error
 }
 
 func New() Builder {
 	return Builder{}
 }
 
+// NewFromConfig creates a builder from the config. An invalid config is reported by BuildE
 func NewFromConfig(cfg *Config) Builder {
+	if err := cfg.Validate(); err != nil {
+		return New().fail(&ConfigError{Option: "NewFromConfig", Err: err})
+	}
+
 	cfg = cfg.withDefaults()
 
 	ret := New().WithCapacity(cfg.Capacity).
@@ -32,8 +58,20 @@ func NewFromConfig(cfg *Config) Builder {
 		ret = ret.WithSync()
 	}
 
-	if cfg.Metrics != nil {
+	if cfg.ConcurrentReads {
+		ret = ret.WithConcurrentReads()
+	}
+
+	if cfg.Metrics != nil && cfg.Metrics.Enabled {
 		ret = ret.WithMetrics(cfg.Metrics.Namespace, cfg.Metrics.Subsystem, cfg.Metrics.Labels)
+
+		if cfg.Metrics.Registerer != nil {
+			ret = ret.WithMetricsRegisterer(cfg.Metrics.Registerer)
+		}
+
+		if cfg.Metrics.Latency != nil {
+			ret = ret.WithLatencyHistograms(cfg.Metrics.Latency.Buckets, cfg.Metrics.Latency.SampleRate)
+		}
 	}
 
 	if cfg.Clock != nil {
@@ -42,12 +80,44 @@ func NewFromConfig(cfg *Config) Builder {
 		}
 	}
 
+	if cfg.MemoryController != nil {
+		ret = ret.WithMemoryController(*cfg.MemoryController)
+	}
+
+	if cfg.HotKeys != nil {
+		ret = ret.WithHotKeys(*cfg.HotKeys)
+	}
+
+	if cfg.PrefixIndex {
+		ret = ret.WithPrefixIndex()
+	}
+
+	if cfg.Priorities != 0 {
+		ret = ret.WithPriorities(cfg.Priorities)
+	}
+
+	if cfg.Pinning != nil {
+		ret = ret.WithMaxPinned(cfg.Pinning.MaxRatio)
+		if cfg.Pinning.Expire {
+			ret = ret.WithPinnedExpiration()
+		}
+	}
+
+	if cfg.Policy != nil {
+		if cfg.Policy.Segmented != nil {
+			ret = ret.WithSegmentedLRU(cfg.Policy.Segmented.ProtectedRatio)
+		}
+		if cfg.Policy.SecondChance != nil {
+			ret = ret.WithSecondChance()
+		}
+	}
+
 	return ret
 }
 
 func (b Builder) WithCapacity(capacity int) Builder {
 	if b.optCapacity != nil {
-		panic("duplicated WithCapacity()")
+		return b.fail(newConfigError("WithCapacity", "duplicated option"))
 	}
 
 	b.optCapacity = &optionCapacity{capacity}
@@ -56,7 +126,7 @@ func (b Builder) WithCapacity(capacity int) Builder {
 
 func (b Builder) WithTTL(ttl time.Duration) Builder {
 	if b.optTTL != nil {
-		panic("duplicated WithTTL()")
+		return b.fail(newConfigError("WithTTL", "duplicated option"))
 	}
 
 	b.optTTL = &optionTTL{ttl}
@@ -65,16 +135,28 @@ func (b Builder) WithTTL(ttl time.Duration) Builder {
 
 func (b Builder) WithSync() Builder {
 	if b.optSync != nil {
-		panic("duplicated WithSync()")
+		return b.fail(newConfigError("WithSync", "duplicated option"))
 	}
 
 	b.optSync = &optionSync{}
 	return b
 }
 
+// WithConcurrentReads makes concurrent cache serve reads under a shared lock.
+// Policy updates caused by reads are buffered and applied in batches under the exclusive lock.
+// Requires WithSync()
+func (b Builder) WithConcurrentReads() Builder {
+	if b.optConcurrentReads != nil {
+		return b.fail(newConfigError("WithConcurrentReads", "duplicated option"))
+	}
+
+	b.optConcurrentReads = &optionConcurrentReads{}
+	return b
+}
+
 func (b Builder) WithMetrics(namespace string, subsystem string, constLabels prometheus.Labels) Builder {
 	if b.optMetrics != nil {
-		panic("duplicated WithMetrics()")
+		return b.fail(newConfigError("WithMetrics", "duplicated option"))
 	}
 
 	b.optMetrics = &optionMetrics{namespace, subsystem, constLabels}
@@ -82,15 +164,160 @@ func (b Builder) WithMetrics(namespace string, subsystem string, constLabels pro
 	return b
 }
 
+// WithMetricsRegisterer sets the registry for metrics. Default is prometheus.DefaultRegisterer.
+// Requires WithMetrics()
+func (b Builder) WithMetricsRegisterer(registerer prometheus.Registerer) Builder {
+	if b.optMetricsRegisterer != nil {
+		return b.fail(newConfigError("WithMetricsRegisterer", "duplicated option"))
+	}
+
+	b.optMetricsRegisterer = &optionMetricsRegisterer{registerer}
+	return b
+}
+
+// WithLatencyHistograms enables histograms of time spent waiting for the lock and holding it by Get, Set and Delete.
+// Only sampleRate share of operations is timed, zero means default 0.01. Nil buckets mean default buckets.
+// Requires WithMetrics() and WithSync()
+func (b Builder) WithLatencyHistograms(buckets []float64, sampleRate float64) Builder {
+	if b.optLatency != nil {
+		return b.fail(newConfigError("WithLatencyHistograms", "duplicated option"))
+	}
+
+	b.optLatency = &optionLatency{buckets, sampleRate}
+	return b
+}
+
+// WithCollector adds the cache to the collector under the given name.
+// The cache is removed from the collector when destroyed
+func (b Builder) WithCollector(collector *Collector, name string) Builder {
+	if b.optCollector != nil {
+		return b.fail(newConfigError("WithCollector", "duplicated option"))
+	}
+
+	b.optCollector = &optionCollector{collector, name}
+	return b
+}
+
 func (b Builder) WithDiscreteClock(updateInterval time.Duration) Builder {
 	if b.optDiscreteClock != nil {
-		panic("duplicated WithDiscreteClock()")
+		return b.fail(newConfigError("WithDiscreteClock", "duplicated option"))
 	}
 
 	b.optDiscreteClock = &optionDiscreteClock{updateInterval}
 	return b
 }
 
+// WithClock makes the cache use the clock for expiration and background tasks, e.g. a fake clock in tests.
+// The clock can be shared by several caches, it's not stopped when the cache is destroyed
+func (b Builder) WithClock(clock Clock) Builder {
+	if b.optClock != nil {
+		return b.fail(newConfigError("WithClock", "duplicated option"))
+	}
+
+	b.optClock = &optionClock{clock}
+	return b
+}
+
+// WithSegmentedLRU makes the cache use segmented LRU eviction policy.
+// protectedRatio is the share of the capacity reserved for keys that were hit at least once.
+func (b Builder) WithSegmentedLRU(protectedRatio float64) Builder {
+	if b.optSegmented != nil {
+		return b.fail(newConfigError("WithSegmentedLRU", "duplicated option"))
+	}
+
+	b.optSegmented = &optionSegmented{protectedRatio}
+	return b
+}
+
+// WithSecondChance makes the cache use CLOCK(second chance) eviction policy.
+// Reads don't modify the cache, so a concurrent cache serves them under a shared lock.
+func (b Builder) WithSecondChance() Builder {
+	if b.optSecondChance != nil {
+		return b.fail(newConfigError("WithSecondChance", "duplicated option"))
+	}
+
+	b.optSecondChance = &optionSecondChance{}
+	return b
+}
+
+// WithTraceRecorder makes the cache record Get, Set and Delete operations to w.
+// Only sampleRate share of the keys is recorded. Records are written in background
+// and dropped when the writer can't keep up. Use trace.Reader to decode them.
+func (b Builder) WithTraceRecorder(w io.Writer, sampleRate float64) Builder {
+	if b.optTraceRecorder != nil {
+		return b.fail(newConfigError("WithTraceRecorder", "duplicated option"))
+	}
+
+	b.optTraceRecorder = &optionTraceRecorder{w, sampleRate}
+	return b
+}
+
+// WithMemoryController makes the cache shrink when the process approaches its memory limit
+// and regrow when memory is available. Requires WithSync()
+func (b Builder) WithMemoryController(cfg MemoryControllerConfig) Builder {
+	if b.optMemory != nil {
+		return b.fail(newConfigError("WithMemoryController", "duplicated option"))
+	}
+
+	b.optMemory = &optionMemoryController{cfg}
+	return b
+}
+
+// WithHotKeys makes the cache track the most requested keys, see TopKeys.
+// Zero fields of cfg mean defaults. With WithMetrics(), counts of the top keys are exported as metrics
+func (b Builder) WithHotKeys(cfg HotKeysConfig) Builder {
+	if b.optHotKeys != nil {
+		return b.fail(newConfigError("WithHotKeys", "duplicated option"))
+	}
+
+	b.optHotKeys = &optionHotKeys{cfg}
+	return b
+}
+
+// WithPrefixIndex makes the cache maintain a radix tree of keys,
+// so DeleteByPrefix doesn't have to scan all keys
+func (b Builder) WithPrefixIndex() Builder {
+	if b.optPrefixIndex != nil {
+		return b.fail(newConfigError("WithPrefixIndex", "duplicated option"))
+	}
+
+	b.optPrefixIndex = &optionPrefixIndex{}
+	return b
+}
+
+// WithPriorities sets the number of priority classes for SetWithPriority.
+// Priorities are numbered from zero, keys of lower priority are evicted first.
+// Set puts new keys into the lowest priority class, overwritten keys keep their class
+func (b Builder) WithPriorities(classes int) Builder {
+	if b.optPriorities != nil {
+		return b.fail(newConfigError("WithPriorities", "duplicated option"))
+	}
+
+	b.optPriorities = &optionPriorities{classes}
+	return b
+}
+
+// WithMaxPinned sets the maximum share of the capacity that can be taken by pinned keys.
+// Default is 0.1
+func (b Builder) WithMaxPinned(ratio float64) Builder {
+	if b.optMaxPinned != nil {
+		return b.fail(newConfigError("WithMaxPinned", "duplicated option"))
+	}
+
+	b.optMaxPinned = &optionMaxPinned{ratio}
+	return b
+}
+
+// WithPinnedExpiration makes pinned keys expire as usual. By default pinned keys never expire
+func (b Builder) WithPinnedExpiration() Builder {
+	if b.optPinnedExpire != nil {
+		return b.fail(newConfigError("WithPinnedExpiration", "duplicated option"))
+	}
+
+	b.optPinnedExpire = &optionPinnedExpiration{}
+	return b
+}
+
 func (b Builder) WithSetCallback(cb func(string)) Builder {
 	b.optSetCallbacks = append(b.optSetCallbacks, &optionSetCallback{cb})
 	return b
@@ -111,10 +338,35 @@ func (b Builder) WithExpireCallback(cb func(string)) Builder {
 	return b
 }
 
+// fail remembers the first error of option setters
+func (b Builder) fail(err error) Builder {
+	if b.err == nil {
+		b.err = err
+	}
+
+	return b
+}
+
+// Build creates the cache. It panics if options are invalid or metrics can't be registered
 func (b Builder) Build() Cache {
+	ret, err := b.BuildE()
+	if err != nil {
+		panic(err)
+	}
+
+	return ret
+}
+
+// BuildE creates the cache. Unlike Build, it returns an error if options are invalid or metrics can't be registered.
+// Invalid and duplicated options are reported as *ConfigError
+func (b Builder) BuildE() (Cache, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
 	// capacity is mandatory
 	if b.optCapacity == nil || b.optCapacity.capacity <= 0 {
-		panic("LRU cache capacity must be greater than zero")
+		return nil, newConfigError("WithCapacity", "capacity must be greater than zero")
 	}
 
 	// nil ttl is same as ttl = 0
@@ -123,7 +375,92 @@ func (b Builder) Build() Cache {
 	}
 
 	if b.optTTL.ttl < 0 {
-		panic("LRU cache TTL must be greater or equal to zero")
+		return nil, newConfigError("WithTTL", "TTL must be greater or equal to zero")
+	}
+
+	if b.optSegmented != nil && (b.optSegmented.protectedRatio <= 0 || b.optSegmented.protectedRatio >= 1) {
+		return nil, newConfigError("WithSegmentedLRU", "protected ratio must be between zero and one")
+	}
+
+	if b.optPriorities == nil {
+		b.optPriorities = &optionPriorities{1}
+	}
+
+	if b.optPriorities.classes <= 0 {
+		return nil, newConfigError("WithPriorities", "priorities must be greater than zero")
+	}
+
+	if b.optMaxPinned == nil {
+		b.optMaxPinned = &optionMaxPinned{defaultMaxPinnedRatio}
+	}
+
+	if b.optMaxPinned.ratio < 0 || b.optMaxPinned.ratio >= 1 {
+		return nil, newConfigError("WithMaxPinned", "max pinned ratio must be in range [0, 1)")
+	}
+
+	if b.optSegmented != nil && b.optSecondChance != nil {
+		return nil, newConfigError("WithSecondChance", "cache can have only one eviction policy")
+	}
+
+	if b.optTraceRecorder != nil && (b.optTraceRecorder.sampleRate <= 0 || b.optTraceRecorder.sampleRate > 1) {
+		return nil, newConfigError("WithTraceRecorder", "sample rate must be greater than zero and not greater than one")
+	}
+
+	if b.optClock != nil && b.optClock.clock == nil {
+		return nil, newConfigError("WithClock", "clock must be set")
+	}
+
+	if b.optClock != nil && b.optDiscreteClock != nil {
+		return nil, newConfigError("WithClock", "cache can have only one clock")
+	}
+
+	if b.optConcurrentReads != nil && b.optSync == nil {
+		return nil, newConfigError("WithConcurrentReads", "concurrent reads require WithSync()")
+	}
+
+	if b.optMetricsRegisterer != nil && b.optMetrics == nil {
+		return nil, newConfigError("WithMetricsRegisterer", "metrics registerer requires WithMetrics()")
+	}
+
+	if b.optLatency != nil {
+		if b.optMetrics == nil || b.optSync == nil {
+			return nil, newConfigError("WithLatencyHistograms", "latency histograms require WithMetrics() and WithSync()")
+		}
+
+		// zero values mean defaults
+		latency := *b.optLatency
+		if latency.sampleRate == 0 {
+			latency.sampleRate = defaultLatencySampleRate
+		}
+		if latency.buckets == nil {
+			latency.buckets = defaultLatencyBuckets
+		}
+
+		if latency.sampleRate < 0 || latency.sampleRate > 1 {
+			return nil, newConfigError("WithLatencyHistograms", "sample rate must be greater than zero and not greater than one")
+		}
+
+		b.optLatency = &latency
+	}
+
+	if b.optCollector != nil && (b.optCollector.collector == nil || b.optCollector.name == "") {
+		return nil, newConfigError("WithCollector", "collector and name must be set")
+	}
+
+	if b.optMemory != nil {
+		if err := b.optMemory.cfg.Validate(); err != nil {
+			return nil, &ConfigError{Option: "WithMemoryController", Err: err}
+		}
+
+		if b.optSync == nil {
+			return nil, newConfigError("WithMemoryController", "memory controller requires WithSync()")
+		}
+	}
+
+	if b.optHotKeys != nil {
+		if err := b.optHotKeys.cfg.Validate(); err != nil {
+			return nil, &ConfigError{Option: "WithHotKeys", Err: err}
+		}
 	}
 
 	var (
@@ -135,30 +472,155 @@ func (b Builder) Build() Cache {
 
 	baseCache := newBase(b.optCapacity.capacity, b.optTTL.ttl)
 
-	if b.optTTL.ttl == 0 {
+	switch {
+	case b.optTTL.ttl == 0:
 		baseCache.setClock(newClockNone())
-	} else {
-		if b.optDiscreteClock == nil {
-			baseCache.setClock(newClockPrecise())
-		} else {
-			baseCache.setClock(newClockDiscrete(b.optDiscreteClock.updateInterval))
-		}
+	case b.optClock != nil:
+		baseCache.setClock(newClockExternal(b.optClock.clock))
+	case b.optDiscreteClock != nil:
+		baseCache.setClock(newClockDiscrete(b.optDiscreteClock.updateInterval))
+	default:
+		baseCache.setClock(newClockPrecise())
+	}
+
+	// background tasks follow the user clock even when keys don't expire
+	var tasksClock Clock = baseCache.clock
+	if b.optClock != nil {
+		tasksClock = b.optClock.clock
+	}
+
+	baseCache.setPinning(b.optMaxPinned.ratio, b.optPinnedExpire != nil)
+
+	if b.optPrefixIndex != nil {
+		baseCache.setPrefixIndex()
+	}
+
+	var segmented []*policySegmented
+
+	switch {
+	case b.optSegmented != nil:
+		baseCache.setPolicies(b.optPriorities.classes, func() policy {
+			p := newPolicySegmented(b.optCapacity.capacity, b.optSegmented.protectedRatio)
+			segmented = append(segmented, p)
+			return p
+		})
+	case b.optSecondChance != nil:
+		baseCache.setPolicies(b.optPriorities.classes, func() policy {
+			return newPolicySecondChance(b.optCapacity.capacity)
+		})
+		baseCache.setLazyExpiration(true)
+	default:
+		baseCache.setPolicies(b.optPriorities.classes, func() policy {
+			return newPolicyLRU(b.optCapacity.capacity)
+		})
 	}
 
 	var ret Cache = baseCache
 
+	registerer := prometheus.DefaultRegisterer
+	if b.optMetricsRegisterer != nil {
+		registerer = b.optMetricsRegisterer.registerer
+	}
+
+	var latency *latencyRecorder
+
 	if b.optMetrics != nil {
-		withMetrics := newWithMetrics(ret,
+		withMetrics, err := newWithMetrics(ret, baseCache, registerer,
 			b.optMetrics.namespace, b.optMetrics.subsystem, b.optMetrics.constLabels)
+		if err != nil {
+			baseCache.Destroy()
+			return nil, err
+		}
 
 		onEvictCallbacks = append(onEvictCallbacks, withMetrics.onEvict)
 		onExpireCallbacks = append(onExpireCallbacks, withMetrics.onExpire)
+		baseCache.onPin = withMetrics.onPin
+		baseCache.onReplace = withMetrics.onReplace
+		baseCache.onUnpin = withMetrics.onUnpin
+
+		for i := range segmented {
+			segmented[i].onPromote = withMetrics.onPromote
+			segmented[i].onDemote = withMetrics.onDemote
+		}
+
+		if b.optLatency != nil {
+			latency, err = withMetrics.registerLatencyMetrics(b.optLatency.buckets, b.optLatency.sampleRate,
+				b.optMetrics.namespace, b.optMetrics.subsystem, b.optMetrics.constLabels)
+			if err != nil {
+				withMetrics.Destroy()
+				return nil, err
+			}
+		}
 
 		ret = withMetrics
 	}
 
+	if b.optTraceRecorder != nil {
+		ret = newWithTrace(ret, baseCache, b.optTraceRecorder.w, b.optTraceRecorder.sampleRate)
+	}
+
 	if b.optSync != nil {
-		ret = newWithSync(ret)
+		switch {
+		case b.optSecondChance != nil:
+			// second chance policy is updated atomically on reads, no need to buffer them
+			ret = newWithRWSync(ret, nil, latency)
+		case b.optConcurrentReads != nil && len(segmented) > 0:
+			// segmented policy is updated on reads, so reads are buffered and applied under the exclusive lock
+			buffer := newReadBuffer(baseCache.applyAccess)
+			baseCache.setRecordAccess(buffer.record)
+			baseCache.setLazyExpiration(true)
+			ret = newWithRWSync(ret, buffer, latency)
+		case b.optConcurrentReads != nil:
+			// default policy ignores reads
+			baseCache.setLazyExpiration(true)
+			ret = newWithRWSync(ret, nil, latency)
+		default:
+			ret = newWithSync(ret, latency)
+		}
+	}
+
+	if b.optHotKeys != nil {
+		withHotKeys := newWithHotKeys(ret, b.optHotKeys.cfg)
+
+		if b.optMetrics != nil {
+			err := withHotKeys.registerMetrics(registerer,
+				b.optMetrics.namespace, b.optMetrics.subsystem, b.optMetrics.constLabels)
+			if err != nil {
+				ret.Destroy()
+				return nil, err
+			}
+		}
+
+		ret = withHotKeys
+	}
+
+	if b.optMemory != nil {
+		withMemory := newWithMemoryController(ret, b.optMemory.cfg, tasksClock)
+
+		if b.optMetrics != nil {
+			err := withMemory.registerMetrics(registerer,
+				b.optMetrics.namespace, b.optMetrics.subsystem, b.optMetrics.constLabels)
+			if err != nil {
+				// the controller is not started yet, so only the wrapped cache needs to be destroyed
+				ret.Destroy()
+				return nil, err
+			}
+		}
+
+		withMemory.start()
+		ret = withMemory
+	}
+
+	if b.optCollector != nil {
+		collector, name := b.optCollector.collector, b.optCollector.name
+
+		// collector reads stats through the outermost cache to take the lock
+		if err := collector.add(name, ret); err != nil {
+			ret.Destroy()
+			return nil, &ConfigError{Option: "WithCollector", Err: err}
+		}
+
+		ret = newWithCollector(ret, collector, name)
 	}
 
 	for i := range b.optEvictCallbacks {
@@ -182,5 +644,5 @@ func (b Builder) Build() Cache {
 	baseCache.onSet = composeKeyCallback(onSetCallbacks...)
 	baseCache.onDelete = composeKeyCallback(onDeleteCallbacks...)
 
-	return ret
+	return ret, nil
 }
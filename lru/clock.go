@@ -1,22 +1,77 @@
 package lru
 
 import (
-	"time"
-
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
-type clock interface {
+// Clock is a source of time for the cache. It's used for expiration and to run background tasks.
+// Implement it to control time in tests or simulations, see lrutest.FakeClock
+type Clock interface {
 	Now() time.Time
+	// Every calls fn every d until stop is called. stop waits for the running call of fn to return
+	Every(d time.Duration, fn func()) (stop func())
+}
+
+type clock interface {
+	Clock
+	// nanotime returns current time in unix nanoseconds, expiration times of keys are kept in this form
+	nanotime() int64
+	// time converts nanotime to time.Time
+	time(nanotime int64) time.Time
 	Stop()
 }
 
+// epoch anchors monotonic readings to the wall clock
+var epoch = time.Now()
+
+// monotime returns monotonic time in unix nanoseconds. Unlike time.Now().UnixNano() it doesn't jump with the wall clock
+func monotime() int64 {
+	return epoch.UnixNano() + int64(time.Since(epoch))
+}
+
+// every calls fn in background on each tick of time.Ticker
+func every(d time.Duration, fn func()) func() {
+	ticker := time.NewTicker(d)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-done
+	}
+}
+
 // ClockNone fake clock, used for cache without expiration
 type ClockNone struct{}
 
 func (c *ClockNone) Now() time.Time {
 	return time.Time{}
 }
+func (c *ClockNone) Every(d time.Duration, fn func()) func() {
+	return every(d, fn)
+}
+func (c *ClockNone) nanotime() int64 {
+	return 0
+}
+func (c *ClockNone) time(nanotime int64) time.Time {
+	return time.Time{}.Add(time.Duration(nanotime))
+}
 func (c *ClockNone) Stop() {}
 
 func newClockNone() clock {
@@ -29,6 +84,15 @@ type ClockPrecise struct{}
 func (c *ClockPrecise) Now() time.Time {
 	return time.Now()
 }
+func (c *ClockPrecise) Every(d time.Duration, fn func()) func() {
+	return every(d, fn)
+}
+func (c *ClockPrecise) nanotime() int64 {
+	return monotime()
+}
+func (c *ClockPrecise) time(nanotime int64) time.Time {
+	return time.Unix(0, nanotime)
+}
 func (c *ClockPrecise) Stop() {}
 
 func newClockPrecise() clock {
@@ -36,23 +100,30 @@ func newClockPrecise() clock {
 }
 
 // ClockDiscrete is an optimized clock. Not as precise as ClockPrecise but significantly faster.
-// Current time is refreshed each 500ms.
+// Current time is refreshed each 500ms by a coarse clock shared by all caches with the same update interval.
 type ClockDiscrete struct {
-	updateTicker *time.Ticker
-	value        *atomic.Value
+	shared   *coarseClock
+	stopOnce sync.Once
 }
 
 func (c *ClockDiscrete) Now() time.Time {
-	now := c.value.Load().(time.Time)
-	return now
+	return time.Unix(0, c.nanotime())
 }
 
-func (c *ClockDiscrete) Stop() {
-	c.updateTicker.Stop()
+func (c *ClockDiscrete) Every(d time.Duration, fn func()) func() {
+	return every(d, fn)
 }
 
-func (c *ClockDiscrete) refresh() {
-	c.value.Store(time.Now())
+func (c *ClockDiscrete) nanotime() int64 {
+	return atomic.LoadInt64(&c.shared.nanos)
+}
+
+func (c *ClockDiscrete) time(nanotime int64) time.Time {
+	return time.Unix(0, nanotime)
+}
+
+func (c *ClockDiscrete) Stop() {
+	c.stopOnce.Do(c.shared.release)
 }
 
 func newClockDiscrete(updateTime time.Duration) clock {
@@ -60,18 +131,69 @@ func newClockDiscrete(updateTime time.Duration) clock {
 		updateTime = time.Millisecond * 500
 	}
 
-	ret := &ClockDiscrete{
-		updateTicker: time.NewTicker(updateTime),
-		value:        &atomic.Value{},
+	return &ClockDiscrete{shared: acquireCoarseClock(updateTime)}
+}
+
+// coarseClock keeps monotonic time refreshed by a single goroutine, so reading it is a single atomic load.
+// Coarse clocks are shared across caches and reference counted, the goroutine stops with the last user
+type coarseClock struct {
+	nanos int64 // first to be 64-bit aligned for atomic access on 32-bit platforms
+
+	interval time.Duration
+	refs     int // guarded by coarseClocksMu
+	stop     func()
+}
+
+var (
+	coarseClocksMu sync.Mutex
+	coarseClocks   = map[time.Duration]*coarseClock{}
+)
+
+func acquireCoarseClock(interval time.Duration) *coarseClock {
+	coarseClocksMu.Lock()
+	defer coarseClocksMu.Unlock()
+
+	c, found := coarseClocks[interval]
+	if !found {
+		c = &coarseClock{nanos: monotime(), interval: interval}
+		c.stop = every(interval, c.refresh)
+		coarseClocks[interval] = c
 	}
 
-	ret.refresh()
+	c.refs++
+	return c
+}
 
-	go func(c *ClockDiscrete) {
-		for range c.updateTicker.C {
-			c.refresh()
-		}
-	}(ret)
+func (c *coarseClock) refresh() {
+	atomic.StoreInt64(&c.nanos, monotime())
+}
+
+func (c *coarseClock) release() {
+	coarseClocksMu.Lock()
+	defer coarseClocksMu.Unlock()
+
+	c.refs--
+	if c.refs == 0 {
+		delete(coarseClocks, c.interval)
+		c.stop()
+	}
+}
+
+// clockExternal is a clock passed by the user. The cache doesn't own it, so it's never stopped
+type clockExternal struct {
+	Clock
+}
+
+func (c clockExternal) nanotime() int64 {
+	return c.Now().UnixNano()
+}
+
+func (c clockExternal) time(nanotime int64) time.Time {
+	return time.Unix(0, nanotime)
+}
+
+func (c clockExternal) Stop() {}
 
-	return ret
+func newClockExternal(c Clock) clock {
+	return clockExternal{c}
 }
@@ -0,0 +1,124 @@
+package lru
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector exports Stats of many caches, distinguished by the cache label.
+// Stats are read at scrape time, so caches don't update prometheus metrics on every operation.
+// Register the collector once, then add caches to it with WithCollector
+type Collector struct {
+	mu     sync.Mutex
+	caches map[string]Cache
+
+	capacity *prometheus.Desc
+	size     *prometheus.Desc
+	hits     *prometheus.Desc
+	misses   *prometheus.Desc
+	evicted  *prometheus.Desc
+	expired  *prometheus.Desc
+	sets     *prometheus.Desc
+	deletes  *prometheus.Desc
+	loads    *prometheus.Desc
+}
+
+func NewCollector(namespace string, subsystem string, constLabels prometheus.Labels) *Collector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, []string{"cache"}, constLabels)
+	}
+
+	return &Collector{
+		caches: make(map[string]Cache),
+
+		capacity: desc("cache_capacity", "Maximum number of items in cache"),
+		size:     desc("cache_size", "Number of items in cache"),
+		hits:     desc("cache_hits_total", "Total amount of cache hits"),
+		misses:   desc("cache_misses_total", "Total amount of cache misses"),
+		evicted:  desc("cache_evicted_total", "Total amount of keys evicted by cache overflow"),
+		expired:  desc("cache_expired_total", "Total amount of expired keys"),
+		sets:     desc("cache_sets_total", "Total amount of writes"),
+		deletes:  desc("cache_deletes_total", "Total amount of deleted keys"),
+		loads: prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "cache_loads_total"),
+			"Total amount of GetOrLoad loader calls", []string{"cache", "result"}, constLabels),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.capacity
+	ch <- c.size
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evicted
+	ch <- c.expired
+	ch <- c.sets
+	ch <- c.deletes
+	ch <- c.loads
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	// caches are read outside of the collector lock, so a cache being destroyed doesn't block the scrape
+	c.mu.Lock()
+	caches := make(map[string]Cache, len(c.caches))
+	for name, cache := range c.caches {
+		caches[name] = cache
+	}
+	c.mu.Unlock()
+
+	for name, cache := range caches {
+		stats := cache.Stats()
+
+		ch <- prometheus.MustNewConstMetric(c.capacity, prometheus.GaugeValue, float64(cache.Capacity()), name)
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(stats.Size), name)
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits), name)
+		ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses), name)
+		ch <- prometheus.MustNewConstMetric(c.evicted, prometheus.CounterValue, float64(stats.Evictions), name)
+		ch <- prometheus.MustNewConstMetric(c.expired, prometheus.CounterValue, float64(stats.Expirations), name)
+		ch <- prometheus.MustNewConstMetric(c.sets, prometheus.CounterValue, float64(stats.Sets), name)
+		ch <- prometheus.MustNewConstMetric(c.deletes, prometheus.CounterValue, float64(stats.Deletes), name)
+		ch <- prometheus.MustNewConstMetric(c.loads, prometheus.CounterValue, float64(stats.LoadSuccesses), name, "success")
+		ch <- prometheus.MustNewConstMetric(c.loads, prometheus.CounterValue, float64(stats.LoadFailures), name, "failure")
+	}
+}
+
+// add starts exporting metrics of the cache. Names must be unique within the collector
+func (c *Collector) add(name string, cache Cache) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.caches[name]; found {
+		return errors.Errorf("cache %q is already added to the collector", name)
+	}
+
+	c.caches[name] = cache
+
+	return nil
+}
+
+// remove stops exporting metrics of the cache. The name is kept if it's taken by another cache already
+func (c *Collector) remove(name string, cache Cache) {
+	c.mu.Lock()
+	if c.caches[name] == cache {
+		delete(c.caches, name)
+	}
+	c.mu.Unlock()
+}
+
+// lruWithCollector is a wrapper for cache that removes the cache from the collector on destroy
+type lruWithCollector struct {
+	Cache
+
+	collector *Collector
+	name      string
+}
+
+func newWithCollector(parent Cache, collector *Collector, name string) *lruWithCollector {
+	return &lruWithCollector{Cache: parent, collector: collector, name: name}
+}
+
+func (c *lruWithCollector) Destroy() {
+	c.collector.remove(c.name, c.Cache)
+	c.Cache.Destroy()
+}
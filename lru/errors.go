@@ -0,0 +1,29 @@
+package lru
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrDestroyed is returned by GetOrLoad of a destroyed cache.
+// Other methods of a destroyed cache behave as if it's empty and drop writes
+var ErrDestroyed = errors.New("LRU cache is destroyed")
+
+// ConfigError is returned by BuildE when the cache is misconfigured.
+// Option is the builder method causing the error, e.g. "WithCapacity", or "NewFromConfig" for an invalid config.
+// Errors of metrics registration are not ConfigError, they are returned as is with the registry error as the cause
+type ConfigError struct {
+	Option string
+	Err    error
+}
+
+func newConfigError(option string, message string) *ConfigError {
+	return &ConfigError{Option: option, Err: errors.New(message)}
+}
+
+func (e *ConfigError) Error() string {
+	return "LRU cache " + e.Option + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
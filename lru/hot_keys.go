@@ -0,0 +1,196 @@
+package lru
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pavel-krush/cache/v2/lru/topk"
+)
+
+const (
+	defaultHotKeysCapacity   = 100
+	defaultHotKeysSampleRate = 0.01
+	defaultHotKeysMetricKeys = 10
+)
+
+// HotKeysConfig configures tracking of the most requested keys.
+// Only SampleRate share of Get and Set calls is counted, so counts are estimates.
+// Capacity is the number of tracked keys, keys requested more often than 1/Capacity of the sampled time are always found.
+// MetricKeys is the number of top keys exported as metrics
+type HotKeysConfig struct {
+	Capacity   int     `mapstructure:"capacity" json:"capacity" yaml:"capacity"`
+	SampleRate float64 `mapstructure:"sample_rate" json:"sample_rate" yaml:"sample_rate"`
+	MetricKeys int     `mapstructure:"metric_keys" json:"metric_keys" yaml:"metric_keys"`
+}
+
+func (c *HotKeysConfig) Validate() error {
+	// empty config is okay
+	if c == nil {
+		return nil
+	}
+
+	if c.Capacity < 0 {
+		return errors.New("capacity must be greater or equal to zero")
+	}
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return errors.New("sample rate must be in range [0, 1]")
+	}
+
+	if c.MetricKeys < 0 {
+		return errors.New("metric keys must be greater or equal to zero")
+	}
+
+	if c.MetricKeys > c.withDefaults().Capacity {
+		return errors.New("metric keys must be less or equal to capacity")
+	}
+
+	return nil
+}
+
+func (c HotKeysConfig) withDefaults() HotKeysConfig {
+	if c.Capacity == 0 {
+		c.Capacity = defaultHotKeysCapacity
+	}
+
+	if c.SampleRate == 0 {
+		c.SampleRate = defaultHotKeysSampleRate
+	}
+
+	if c.MetricKeys == 0 {
+		c.MetricKeys = defaultHotKeysMetricKeys
+	}
+
+	return c
+}
+
+// HotKey is a frequently requested key. Count is an estimated number of Get and Set calls with the key
+type HotKey struct {
+	Key   string
+	Count uint64
+}
+
+// lruWithHotKeys is a wrapper for cache that counts sampled Get and Set calls to find the most requested keys.
+// Keys are counted outside of the cache lock
+type lruWithHotKeys struct {
+	Cache
+
+	cfg     HotKeysConfig
+	every   uint64
+	counter uint64
+	tracker *topk.Tracker
+
+	registration *metricsRegistration
+}
+
+func newWithHotKeys(parent Cache, cfg HotKeysConfig) *lruWithHotKeys {
+	cfg = cfg.withDefaults()
+
+	return &lruWithHotKeys{
+		Cache:   parent,
+		cfg:     cfg,
+		every:   uint64(math.Round(1 / cfg.SampleRate)),
+		tracker: topk.New(cfg.Capacity),
+	}
+}
+
+func (c *lruWithHotKeys) registerMetrics(
+	registerer prometheus.Registerer,
+	namespace string,
+	subsystem string,
+	constLabels prometheus.Labels,
+) error {
+	c.registration = &metricsRegistration{registerer: registerer}
+	return c.registration.register(&hotKeysCollector{
+		cache: c,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "cache_hot_key_requests"),
+			"Estimated total amount of requests of the most requested keys by rank",
+			[]string{"rank", "key_hash"}, constLabels,
+		),
+	})
+}
+
+func (c *lruWithHotKeys) record(key string) {
+	if atomic.AddUint64(&c.counter, 1)%c.every == 0 {
+		c.tracker.Add(key)
+	}
+}
+
+func (c *lruWithHotKeys) Get(key string) (interface{}, bool) {
+	c.record(key)
+	return c.Cache.Get(key)
+}
+
+func (c *lruWithHotKeys) GetMany(keys []string) ([]interface{}, []bool) {
+	for i := range keys {
+		c.record(keys[i])
+	}
+
+	return c.Cache.GetMany(keys)
+}
+
+func (c *lruWithHotKeys) Set(key string, value interface{}) {
+	c.record(key)
+	c.Cache.Set(key, value)
+}
+
+func (c *lruWithHotKeys) SetMany(items map[string]interface{}) {
+	for key := range items {
+		c.record(key)
+	}
+
+	c.Cache.SetMany(items)
+}
+
+func (c *lruWithHotKeys) TopKeys(n int) []HotKey {
+	top := c.tracker.Top(n)
+
+	ret := make([]HotKey, len(top))
+	for i := range top {
+		// every sampled call stands for c.every calls
+		ret[i] = HotKey{Key: top[i].Key, Count: top[i].Count * c.every}
+	}
+
+	return ret
+}
+
+func (c *lruWithHotKeys) Destroy() {
+	if c.registration != nil {
+		c.registration.unregister()
+	}
+
+	c.Cache.Destroy()
+}
+
+// HotKeyHash returns the key_hash label of the key in the hot keys metric
+func HotKeyHash(key string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+// hotKeysCollector exports only the top keys on scrape. Keys are labeled with their rank and hash,
+// so the number of series is bounded and key contents don't leak into metrics.
+// The count of a rank decreases when another key takes it, so counts are exported as gauges
+type hotKeysCollector struct {
+	cache *lruWithHotKeys
+	desc  *prometheus.Desc
+}
+
+func (h *hotKeysCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *hotKeysCollector) Collect(ch chan<- prometheus.Metric) {
+	for i, hotKey := range h.cache.TopKeys(h.cache.cfg.MetricKeys) {
+		ch <- prometheus.MustNewConstMetric(h.desc, prometheus.GaugeValue, float64(hotKey.Count),
+			strconv.Itoa(i+1), HotKeyHash(hotKey.Key))
+	}
+}
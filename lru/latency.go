@@ -0,0 +1,81 @@
+package lru
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultLatencySampleRate = 0.01
+
+// defaultLatencyBuckets cover 100ns..26ms, cache operations are fast
+var defaultLatencyBuckets = prometheus.ExponentialBuckets(100e-9, 4, 10)
+
+type latencyOp int
+
+const (
+	latencyOpGet latencyOp = iota
+	latencyOpSet
+	latencyOpDelete
+
+	latencyOpsCount
+)
+
+var latencyOpNames = [latencyOpsCount]string{"get", "set", "delete"}
+
+// latencyRecorder observes the time spent waiting for the lock and holding it.
+// Only every n-th operation is timed to keep the overhead low
+type latencyRecorder struct {
+	every   uint64
+	counter uint64
+
+	lockWait  [latencyOpsCount]prometheus.Observer
+	operation [latencyOpsCount]prometheus.Observer
+}
+
+func newLatencyRecorder(sampleRate float64, lockWait *prometheus.HistogramVec, operation *prometheus.HistogramVec) *latencyRecorder {
+	ret := &latencyRecorder{
+		every: uint64(math.Round(1 / sampleRate)),
+	}
+
+	for op := range latencyOpNames {
+		ret.lockWait[op] = lockWait.WithLabelValues(latencyOpNames[op])
+		ret.operation[op] = operation.WithLabelValues(latencyOpNames[op])
+	}
+
+	return ret
+}
+
+// start returns a timer for the operation. Returns an empty timer if the recorder is nil or the operation is not sampled
+func (r *latencyRecorder) start() latencyTimer {
+	if r == nil || atomic.AddUint64(&r.counter, 1)%r.every != 0 {
+		return latencyTimer{}
+	}
+
+	return latencyTimer{recorder: r, start: time.Now()}
+}
+
+type latencyTimer struct {
+	recorder *latencyRecorder
+	start    time.Time
+	lockedAt time.Time
+}
+
+// locked is called when the lock is acquired
+func (t *latencyTimer) locked() {
+	if t.recorder != nil {
+		t.lockedAt = time.Now()
+	}
+}
+
+// done is called when the lock is released
+func (t *latencyTimer) done(op latencyOp) {
+	if t.recorder == nil {
+		return
+	}
+
+	t.recorder.lockWait[op].Observe(t.lockedAt.Sub(t.start).Seconds())
+	t.recorder.operation[op].Observe(time.Since(t.lockedAt).Seconds())
+}
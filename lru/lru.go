@@ -6,15 +6,46 @@ import (
 
 type Cache interface {
 	Capacity() int
+	Resize(capacity int)
+	Len() int
+	Keys() []string
+	Range(fn func(key string, value interface{}, expireAt time.Time) bool)
+	RangeReverse(fn func(key string, value interface{}, expireAt time.Time) bool)
 	Exists(key string) bool
 	Set(key string, value interface{})
+	SetPinned(key string, value interface{}) bool
+	SetWithPriority(key string, value interface{}, priority int)
+	SetWithTags(key string, value interface{}, tags ...string)
+	InvalidateTag(tag string) int
+	Pin(key string) bool
+	Unpin(key string) bool
 	Delete(key string) bool
+	GetMany(keys []string) ([]interface{}, []bool)
+	SetMany(items map[string]interface{})
+	DeleteMany(keys []string) int
+	DeleteByPrefix(prefix string) int
+	DeleteFunc(fn func(key string, value interface{}) bool) int
+	Purge()
+	PurgeWithCallbacks()
 	Get(key string) (interface{}, bool)
+	Peek(key string) (interface{}, bool)
+	Touch(key string) bool
+	TouchWithTTL(key string, ttl time.Duration) bool
+	GetOrSet(key string, value interface{}) (interface{}, bool)
+	GetOrLoad(key string, load func(key string) (interface{}, error)) (interface{}, error)
+	Compute(key string, fn func(old interface{}, exists bool) (interface{}, bool)) (interface{}, bool)
+	CompareAndSwap(key string, old, new interface{}) bool
+	CompareAndDelete(key string, old interface{}) bool
 	TTL(key string) (time.Duration, bool)
+	Stats() Stats
+	TopKeys(n int) []HotKey
 	Destroy()
 }
 
 type item struct {
+	key      string
 	data     interface{}
-	expireAt time.Time
+	expireAt int64 // nanotime of the cache clock
+	priority int
+	tags     []string
 }
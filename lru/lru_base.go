@@ -1,31 +1,70 @@
 package lru
 
 import (
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/pavel-krush/cache/v2/lru/queue"
+	"github.com/pavel-krush/cache/v2/lru/radix"
 )
 
 type base struct {
-	ttl             time.Duration
-	clock           clock
-	expirationQueue *queue.Queue
+	ttl   time.Duration
+	clock clock
+
+	// policies holds a policy per priority class. Victims are taken from the lowest non-empty class
+	policies []policy
+	// priorityLen is the number of keys per priority class, stored atomically to be read by metrics
+	priorityLen []int64
 
 	capacity int
 	storage  map[string]*item
 
-	onSet    func(string)
-	onDelete func(string)
-	onEvict  func(string)
-	onExpire func(string)
+	// lazyExpiration makes Get read-only: expired keys are not removed on read,
+	// they are removed on overwrite or when chosen as eviction victims.
+	// It allows calling Get under a read lock when the policy supports concurrent access.
+	lazyExpiration bool
+
+	// recordAccess defers policy updates on read, so Get can be called under a read lock. Optional
+	recordAccess func(it *item)
+
+	// prefixIndex allows to delete keys by prefix without scanning the storage. Optional
+	prefixIndex *radix.Tree
+
+	// tags maps tags to keys for InvalidateTag
+	tags *tagIndex
+
+	// pinned keys are not tracked by the policy, so they are never evicted
+	pinned           map[string]struct{}
+	maxPinned        int
+	maxPinnedRatio   float64
+	pinnedExpiration bool
+
+	// stats are always counted, they are cheap enough
+	stats counters
+
+	// destroyed cache behaves as an empty one and drops writes
+	destroyed bool
+
+	onSet     func(string)
+	onDelete  func(string)
+	onEvict   func(string)
+	onExpire  func(string)
+	onPin     func(string)
+	onReplace func(string)
+	onUnpin   func(string)
 }
 
 func newBase(capacity int, ttl time.Duration) *base {
 	ret := &base{
-		ttl:             ttl,
-		expirationQueue: queue.New(capacity),
-		capacity:        capacity,
-		storage:         make(map[string]*item),
+		ttl:         ttl,
+		policies:    []policy{newPolicyLRU(capacity)},
+		priorityLen: make([]int64, 1),
+		capacity:    capacity,
+		storage:     make(map[string]*item),
+		tags:        newTagIndex(),
+		pinned:      make(map[string]struct{}),
 	}
 
 	return ret
@@ -35,37 +74,406 @@ func (c *base) setClock(clock clock) {
 	c.clock = clock
 }
 
+// setPolicies sets the number of priority classes and creates a policy for each of them
+func (c *base) setPolicies(classes int, newPolicy func() policy) {
+	c.policies = make([]policy, classes)
+	for i := range c.policies {
+		c.policies[i] = newPolicy()
+	}
+	c.priorityLen = make([]int64, classes)
+}
+
+func (c *base) setPrefixIndex() {
+	c.prefixIndex = radix.New()
+}
+
+func (c *base) setRecordAccess(recordAccess func(it *item)) {
+	c.recordAccess = recordAccess
+}
+
+// applyAccess updates the policy with the deferred access.
+// The access is ignored if the item has been removed or replaced since
+func (c *base) applyAccess(it *item) {
+	if c.storage[it.key] != it {
+		return
+	}
+
+	if _, pinned := c.pinned[it.key]; pinned {
+		return
+	}
+
+	c.policies[it.priority].Access(it.key)
+}
+
+func (c *base) setLazyExpiration(lazyExpiration bool) {
+	c.lazyExpiration = lazyExpiration
+}
+
+// setPinning sets the maximum share of the capacity that can be pinned,
+// and whether pinned keys expire as usual.
+func (c *base) setPinning(maxPinnedRatio float64, pinnedExpiration bool) {
+	c.maxPinnedRatio = maxPinnedRatio
+	c.pinnedExpiration = pinnedExpiration
+	c.updateMaxPinned()
+}
+
+func (c *base) updateMaxPinned() {
+	c.maxPinned = int(float64(c.capacity) * c.maxPinnedRatio)
+	// at least one key must stay evictable
+	if c.maxPinned >= c.capacity {
+		c.maxPinned = c.capacity - 1
+	}
+}
+
 func (c *base) Capacity() int {
 	return c.capacity
 }
 
+// Resize changes the capacity of the cache. When the cache shrinks, excess keys are evicted
+// calling the eviction hook. Excess pinned keys are unpinned first. Capacity less than one is ignored
+func (c *base) Resize(capacity int) {
+	if capacity <= 0 || c.destroyed {
+		return
+	}
+
+	c.capacity = capacity
+	c.updateMaxPinned()
+
+	for key := range c.pinned {
+		if len(c.pinned) <= c.maxPinned {
+			break
+		}
+		c.Unpin(key)
+	}
+
+	for len(c.storage) > c.capacity {
+		c.evict()
+	}
+
+	for i := range c.policies {
+		c.policies[i].Resize(capacity)
+	}
+}
+
+// Len returns the number of keys in the cache. Expired keys that were not removed yet are counted
+func (c *base) Len() int {
+	return len(c.storage)
+}
+
+// Keys returns not expired keys in eviction order, starting from the next victim
+func (c *base) Keys() []string {
+	ret := make([]string, 0, len(c.storage))
+	c.Range(func(key string, _ interface{}, _ time.Time) bool {
+		ret = append(ret, key)
+		return true
+	})
+
+	return ret
+}
+
+// Range calls fn for each not expired key in eviction order, starting from the next victim.
+// Lower priority classes go first, pinned keys go last. Stops when fn returns false.
+// expireAt is zero for caches without TTL. fn must not modify the cache
+func (c *base) Range(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.rangeKeys(false, c.rangeFunc(fn))
+}
+
+// RangeReverse is the same as Range, but walks from the newest key to the next victim
+func (c *base) RangeReverse(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.rangeKeys(true, c.rangeFunc(fn))
+}
+
+// rangeFunc skips expired keys
+func (c *base) rangeFunc(fn func(key string, value interface{}, expireAt time.Time) bool) func(string) bool {
+	now := c.clock.nanotime()
+
+	return func(key string) bool {
+		it := c.storage[key]
+		if c.isExpired(key, it, now) {
+			return true
+		}
+
+		return fn(key, it.data, c.clock.time(it.expireAt))
+	}
+}
+
+func (c *base) rangeKeys(reverse bool, fn func(key string) bool) {
+	stopped := false
+	wrapped := func(key string) bool {
+		stopped = !fn(key)
+		return !stopped
+	}
+
+	if reverse {
+		c.rangePinned(wrapped)
+		for i := len(c.policies) - 1; i >= 0 && !stopped; i-- {
+			c.policies[i].RangeReverse(wrapped)
+		}
+		return
+	}
+
+	for i := 0; i < len(c.policies) && !stopped; i++ {
+		c.policies[i].Range(wrapped)
+	}
+	if !stopped {
+		c.rangePinned(wrapped)
+	}
+}
+
+func (c *base) rangePinned(fn func(key string) bool) {
+	for key := range c.pinned {
+		if !fn(key) {
+			return
+		}
+	}
+}
+
 func (c *base) Exists(key string) bool {
 	return c.storage[key] != nil
 }
 
+// Set sets the key. A new key goes to the lowest priority class, an existing key keeps its class
 func (c *base) Set(key string, value interface{}) {
-	c.storage[key] = &item{data: value, expireAt: c.clock.Now().Add(c.ttl)}
+	c.set(key, value, keepPriority, false, nil)
+}
 
-	// remove excess item
-	if len(c.storage) > c.capacity {
-		oldestKey, found := c.expirationQueue.Shift()
-		if !found {
-			panic("cache corrupted")
+// SetPinned sets the key and pins it. Returns false if the key is stored unpinned
+// because the maximum number of pinned keys is reached
+func (c *base) SetPinned(key string, value interface{}) bool {
+	return c.set(key, value, keepPriority, true, nil)
+}
+
+// SetWithPriority sets the key in given priority class. Keys of lower priority are evicted first.
+// Priority is clamped to the range of configured classes
+func (c *base) SetWithPriority(key string, value interface{}, priority int) {
+	if priority < 0 {
+		priority = 0
+	}
+	if priority >= len(c.policies) {
+		priority = len(c.policies) - 1
+	}
+
+	c.set(key, value, priority, false, nil)
+}
+
+// SetWithTags sets the key and attaches tags to it. Tags of the previous value are detached
+func (c *base) SetWithTags(key string, value interface{}, tags ...string) {
+	c.set(key, value, keepPriority, false, tags)
+}
+
+// InvalidateTag deletes all keys tagged with the tag. Returns the number of deleted keys
+func (c *base) InvalidateTag(tag string) int {
+	return c.DeleteMany(c.tags.keysOf(tag))
+}
+
+// update replaces the value of the key by atomic operations. The key keeps its priority class, pin state and tags.
+// Tags of an expired key are dropped, they describe the expired value, not the new one
+func (c *base) update(key string, value interface{}) {
+	var tags []string
+	if prev := c.storage[key]; prev != nil && !c.isExpired(key, prev, c.clock.nanotime()) {
+		tags = prev.tags
+	}
+
+	c.set(key, value, keepPriority, false, tags)
+}
+
+// keepPriority makes set keep the priority class of an existing key. New keys go to the lowest class
+const keepPriority = -1
+
+func (c *base) set(key string, value interface{}, priority int, pin bool, tags []string) bool {
+	if c.destroyed {
+		return false
+	}
+
+	_, pinned := c.pinned[key]
+
+	prev := c.storage[key]
+	if priority == keepPriority {
+		priority = 0
+		if prev != nil {
+			priority = prev.priority
 		}
+	}
+	c.storage[key] = &item{key: key, data: value, expireAt: c.clock.nanotime() + int64(c.ttl), priority: priority, tags: tags}
 
-		if oldestKey != key {
-			delete(c.storage, oldestKey)
-			if c.onEvict != nil {
-				c.onEvict(oldestKey)
-			}
+	if prev != nil && len(prev.tags) > 0 {
+		c.tags.remove(key, prev.tags)
+	}
+	if len(tags) > 0 {
+		c.tags.add(key, tags)
+	}
+
+	if prev == nil {
+		c.addPriorityLen(priority, 1)
+		if c.prefixIndex != nil {
+			c.prefixIndex.Insert(key)
 		}
+	} else if prev.priority != priority {
+		c.addPriorityLen(prev.priority, -1)
+		c.addPriorityLen(priority, 1)
+
+		if !pinned {
+			c.policies[prev.priority].Delete(key)
+		}
+	}
+
+	// remove excess item
+	if len(c.storage) > c.capacity {
+		c.evict()
 	}
 
-	c.expirationQueue.Push(key)
+	if !pinned && pin && len(c.pinned) < c.maxPinned {
+		c.policies[priority].Delete(key)
+		c.pin(key)
+		pinned = true
+	}
 
+	if !pinned {
+		c.policies[priority].Push(key)
+	}
+
+	atomic.AddUint64(&c.stats.sets, 1)
 	if c.onSet != nil {
 		c.onSet(key)
 	}
+
+	if prev != nil && c.onReplace != nil {
+		c.onReplace(key)
+	}
+
+	return pinned || !pin
+}
+
+// evict removes the victim from the lowest non-empty priority class
+func (c *base) evict() {
+	var (
+		oldestKey string
+		found     bool
+	)
+
+	for i := range c.policies {
+		oldestKey, found = c.policies[i].Shift()
+		if found {
+			break
+		}
+	}
+
+	if !found {
+		panic("cache corrupted")
+	}
+
+	oldest := c.storage[oldestKey]
+	delete(c.storage, oldestKey)
+	c.addPriorityLen(oldest.priority, -1)
+	if c.prefixIndex != nil {
+		c.prefixIndex.Delete(oldestKey)
+	}
+	c.tags.remove(oldestKey, oldest.tags)
+
+	if c.lazyExpiration && oldest.expireAt < c.clock.nanotime() {
+		atomic.AddUint64(&c.stats.expirations, 1)
+		if c.onExpire != nil {
+			c.onExpire(oldestKey)
+		}
+	} else {
+		atomic.AddUint64(&c.stats.evictions, 1)
+		if c.onEvict != nil {
+			c.onEvict(oldestKey)
+		}
+	}
+}
+
+func (c *base) addPriorityLen(priority int, delta int64) {
+	atomic.AddInt64(&c.priorityLen[priority], delta)
+}
+
+// PriorityLen returns the number of keys in given priority class
+func (c *base) PriorityLen(priority int) int {
+	return int(atomic.LoadInt64(&c.priorityLen[priority]))
+}
+
+// Pin protects the key from eviction. Returns false if the key doesn't exist
+// or the maximum number of pinned keys is reached
+func (c *base) Pin(key string) bool {
+	it, found := c.storage[key]
+	if !found {
+		return false
+	}
+
+	if _, pinned := c.pinned[key]; pinned {
+		return true
+	}
+
+	if len(c.pinned) >= c.maxPinned {
+		return false
+	}
+
+	c.policies[it.priority].Delete(key)
+	c.pin(key)
+
+	return true
+}
+
+// Unpin makes the key evictable again. The key becomes the newest one.
+// Returns false if the key is not pinned
+func (c *base) Unpin(key string) bool {
+	if _, pinned := c.pinned[key]; !pinned {
+		return false
+	}
+
+	c.unpin(key)
+	c.policies[c.storage[key].priority].Push(key)
+
+	return true
+}
+
+func (c *base) pin(key string) {
+	c.pinned[key] = struct{}{}
+
+	if c.onPin != nil {
+		c.onPin(key)
+	}
+}
+
+func (c *base) unpin(key string) {
+	delete(c.pinned, key)
+
+	if c.onUnpin != nil {
+		c.onUnpin(key)
+	}
+}
+
+// remove removes the key from the storage and the policy
+func (c *base) remove(key string) {
+	it := c.storage[key]
+
+	if _, pinned := c.pinned[key]; pinned {
+		c.unpin(key)
+	} else {
+		c.policies[it.priority].Delete(key)
+	}
+
+	delete(c.storage, key)
+	c.addPriorityLen(it.priority, -1)
+	if c.prefixIndex != nil {
+		c.prefixIndex.Delete(key)
+	}
+	c.tags.remove(key, it.tags)
+}
+
+// isExpired checks whether the item is expired. Pinned keys may never expire
+func (c *base) isExpired(key string, it *item, now int64) bool {
+	if it.expireAt >= now {
+		return false
+	}
+
+	if !c.pinnedExpiration {
+		if _, pinned := c.pinned[key]; pinned {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (c *base) Delete(key string) bool {
@@ -73,9 +481,9 @@ func (c *base) Delete(key string) bool {
 		return false
 	}
 
-	c.expirationQueue.Delete(key)
-	delete(c.storage, key)
+	c.remove(key)
 
+	atomic.AddUint64(&c.stats.deletes, 1)
 	if c.onDelete != nil {
 		c.onDelete(key)
 	}
@@ -84,16 +492,26 @@ func (c *base) Delete(key string) bool {
 }
 
 func (c *base) Get(key string) (interface{}, bool) {
+	value, found := c.get(key, c.clock.nanotime())
+	c.stats.addLookup(found)
+
+	return value, found
+}
+
+func (c *base) get(key string, now int64) (interface{}, bool) {
 	it, found := c.storage[key]
 	if !found {
 		return nil, false
 	}
 
-	now := c.clock.Now()
-	if it.expireAt.Before(now) {
-		c.expirationQueue.Delete(key)
-		delete(c.storage, key)
+	if c.isExpired(key, it, now) {
+		if c.lazyExpiration {
+			return nil, false
+		}
 
+		c.remove(key)
+
+		atomic.AddUint64(&c.stats.expirations, 1)
 		if c.onExpire != nil {
 			c.onExpire(key)
 		}
@@ -101,21 +519,282 @@ func (c *base) Get(key string) (interface{}, bool) {
 		return nil, false
 	}
 
+	if c.recordAccess != nil {
+		c.recordAccess(it)
+	} else {
+		c.policies[it.priority].Access(key)
+	}
+
 	return it.data, true
 }
 
+// Peek returns the value of the key without updating recency, removing expired key or calling hooks
+func (c *base) Peek(key string) (interface{}, bool) {
+	it, found := c.storage[key]
+	if !found || c.isExpired(key, it, c.clock.nanotime()) {
+		return nil, false
+	}
+
+	return it.data, true
+}
+
+// Touch makes the key the newest one and refreshes its expiration time without rewriting the value.
+// Returns false if the key doesn't exist or is expired
+func (c *base) Touch(key string) bool {
+	return c.TouchWithTTL(key, c.ttl)
+}
+
+// TouchWithTTL is the same as Touch, but the key expires after given ttl
+func (c *base) TouchWithTTL(key string, ttl time.Duration) bool {
+	now := c.clock.nanotime()
+
+	if _, found := c.get(key, now); !found {
+		return false
+	}
+
+	it := c.storage[key]
+	it.expireAt = now + int64(ttl)
+
+	if _, pinned := c.pinned[key]; !pinned {
+		c.policies[it.priority].Push(key)
+	}
+
+	return true
+}
+
+// GetOrSet returns the existing value of the key if present. Otherwise, it sets the key to the given value.
+// The loaded result is true if the value was loaded, false if stored
+func (c *base) GetOrSet(key string, value interface{}) (interface{}, bool) {
+	if actual, found := c.Get(key); found {
+		return actual, true
+	}
+
+	c.update(key, value)
+
+	return value, false
+}
+
+// GetOrLoad returns the value of the key if present. Otherwise, it stores and returns the value returned by load.
+// If load fails, nothing is stored and the error is returned. Returns ErrDestroyed without calling load if the cache is destroyed
+func (c *base) GetOrLoad(key string, load func(key string) (interface{}, error)) (interface{}, error) {
+	if c.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	if value, found := c.Get(key); found {
+		return value, nil
+	}
+
+	value, err := load(key)
+	if err != nil {
+		atomic.AddUint64(&c.stats.loadFailures, 1)
+		return nil, err
+	}
+
+	atomic.AddUint64(&c.stats.loadSuccesses, 1)
+	c.Set(key, value)
+
+	return value, nil
+}
+
+// Compute calls fn with the current value of the key and stores the value returned by fn.
+// If fn returns false, the key is deleted. Returns the new value and whether it was stored
+func (c *base) Compute(key string, fn func(old interface{}, exists bool) (interface{}, bool)) (interface{}, bool) {
+	old, exists := c.Get(key)
+
+	value, keep := fn(old, exists)
+	if keep {
+		c.update(key, value)
+		return value, true
+	}
+
+	if exists {
+		c.Delete(key)
+	}
+
+	return nil, false
+}
+
+// CompareAndSwap sets the key to the new value if its current value is equal to old.
+// Values of uncomparable types, e.g. slices or maps, are never equal
+func (c *base) CompareAndSwap(key string, old, new interface{}) bool {
+	current, found := c.get(key, c.clock.nanotime())
+	if !found || !equal(current, old) {
+		return false
+	}
+
+	c.update(key, new)
+
+	return true
+}
+
+// CompareAndDelete deletes the key if its current value is equal to old.
+// Values of uncomparable types, e.g. slices or maps, are never equal
+func (c *base) CompareAndDelete(key string, old interface{}) bool {
+	current, found := c.get(key, c.clock.nanotime())
+	if !found || !equal(current, old) {
+		return false
+	}
+
+	return c.Delete(key)
+}
+
+// equal compares values with ==. Values of uncomparable types are not equal instead of panicking
+func equal(a, b interface{}) bool {
+	if a != nil && !reflect.TypeOf(a).Comparable() || b != nil && !reflect.TypeOf(b).Comparable() {
+		return false
+	}
+
+	return a == b
+}
+
+// GetMany returns values and found flags aligned with given keys
+func (c *base) GetMany(keys []string) ([]interface{}, []bool) {
+	values := make([]interface{}, len(keys))
+	found := make([]bool, len(keys))
+
+	// all keys are checked at the same moment
+	now := c.clock.nanotime()
+	hits := 0
+	for i, key := range keys {
+		values[i], found[i] = c.get(key, now)
+		if found[i] {
+			hits++
+		}
+	}
+
+	c.stats.add(&c.stats.hits, hits)
+	c.stats.add(&c.stats.misses, len(keys)-hits)
+
+	return values, found
+}
+
+func (c *base) SetMany(items map[string]interface{}) {
+	for key, val := range items {
+		c.Set(key, val)
+	}
+}
+
+// DeleteMany deletes given keys. Returns the number of deleted keys
+func (c *base) DeleteMany(keys []string) int {
+	ret := 0
+	for _, key := range keys {
+		if c.Delete(key) {
+			ret++
+		}
+	}
+
+	return ret
+}
+
+// Purge removes all keys from the cache without calling the delete, evict or expire hooks.
+// Pinned keys are unpinned through the unpin hook, so the pinned keys metric drops to zero
+func (c *base) Purge() {
+	if c.destroyed {
+		return
+	}
+
+	for key := range c.pinned {
+		c.unpin(key)
+	}
+
+	c.storage = make(map[string]*item)
+	for i := range c.policies {
+		c.policies[i].Reset()
+		atomic.StoreInt64(&c.priorityLen[i], 0)
+	}
+
+	if c.prefixIndex != nil {
+		c.prefixIndex = radix.New()
+	}
+	c.tags.reset()
+}
+
+// PurgeWithCallbacks removes all keys from the cache calling delete hook for each of them
+func (c *base) PurgeWithCallbacks() {
+	c.stats.add(&c.stats.deletes, len(c.storage))
+
+	if c.onDelete == nil {
+		c.Purge()
+		return
+	}
+
+	keys := make([]string, 0, len(c.storage))
+	for key := range c.storage {
+		keys = append(keys, key)
+	}
+
+	c.Purge()
+
+	for _, key := range keys {
+		c.onDelete(key)
+	}
+}
+
+// DeleteByPrefix deletes all keys starting with the prefix. Returns the number of deleted keys.
+// Without prefix index all keys are scanned
+func (c *base) DeleteByPrefix(prefix string) int {
+	var keys []string
+
+	if c.prefixIndex != nil {
+		c.prefixIndex.WalkPrefix(prefix, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+	} else {
+		for key := range c.storage {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return c.DeleteMany(keys)
+}
+
+// DeleteFunc deletes all keys for which fn returns true. Returns the number of deleted keys
+func (c *base) DeleteFunc(fn func(key string, value interface{}) bool) int {
+	var keys []string
+	for key, it := range c.storage {
+		if fn(key, it.data) {
+			keys = append(keys, key)
+		}
+	}
+
+	return c.DeleteMany(keys)
+}
+
 // get TTL on key
 func (c *base) TTL(key string) (time.Duration, bool) {
 	it, found := c.storage[key]
-	if found {
+	if !found {
 		return 0, false
 	}
-	return it.expireAt.Sub(c.clock.Now()), true
+	return time.Duration(it.expireAt - c.clock.nanotime()), true
+}
+
+func (c *base) Stats() Stats {
+	return c.stats.snapshot(len(c.storage))
 }
 
+// TopKeys returns nothing, hot keys are tracked by a wrapper when enabled
+func (c *base) TopKeys(n int) []HotKey {
+	return nil
+}
+
+// Destroy releases the storage and stops the clock. The destroyed cache behaves as an empty one:
+// reads miss, writes are dropped and GetOrLoad returns ErrDestroyed. Destroying twice is a no-op
 func (c *base) Destroy() {
-	c.expirationQueue = nil
+	if c.destroyed {
+		return
+	}
+
+	c.destroyed = true
+	c.policies = nil
 	c.storage = nil
+	c.pinned = nil
+	c.prefixIndex = nil
+	c.tags = newTagIndex()
 	c.clock.Stop()
 }
 
@@ -1,29 +1,107 @@
 package lru
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// lruWithMetrics is a wrapper for cache that exports prometheus metrics
+// metricsRegistration registers collectors and remembers them to unregister on destroy
+type metricsRegistration struct {
+	registerer prometheus.Registerer
+	collectors []prometheus.Collector
+}
+
+// register registers collectors one by one. On error, collectors registered by this call are kept,
+// call unregister to roll them back
+func (r *metricsRegistration) register(collectors ...prometheus.Collector) error {
+	for _, collector := range collectors {
+		if err := r.registerer.Register(collector); err != nil {
+			return errors.Wrap(err, "register metric")
+		}
+
+		r.collectors = append(r.collectors, collector)
+	}
+
+	return nil
+}
+
+func (r *metricsRegistration) unregister() {
+	for _, collector := range r.collectors {
+		r.registerer.Unregister(collector)
+	}
+
+	r.collectors = nil
+}
+
+type metricsOp int
+
+const (
+	metricsOpGet metricsOp = iota
+	metricsOpGetMany
+	metricsOpExists
+	metricsOpTTL
+	metricsOpSet
+	metricsOpSetMany
+	metricsOpDelete
+	metricsOpDeleteMany
+	metricsOpTouch
+	metricsOpGetOrSet
+	metricsOpGetOrLoad
+	metricsOpCompute
+	metricsOpCompareAndSwap
+	metricsOpCompareAndDelete
+
+	metricsOpsCount
+)
+
+var metricsOpNames = [metricsOpsCount]string{
+	"get", "get_many", "exists", "ttl", "set", "set_many", "delete", "delete_many", "touch",
+	"get_or_set", "get_or_load", "compute", "compare_and_swap", "compare_and_delete",
+}
+
+// lruWithMetrics is a wrapper for cache that exports prometheus metrics.
+// Only reads count as hits or misses: Get, GetMany, GetOrSet, GetOrLoad and Compute
 type lruWithMetrics struct {
 	parent Cache
 
-	capacityMetric prometheus.Gauge
-	hitsMetric     prometheus.Counter
-	missesMetric   prometheus.Counter
-	evictedMetric  prometheus.Counter
-	expiredMetric  prometheus.Counter
+	registration *metricsRegistration
+
+	capacityMetric   prometheus.Gauge
+	sizeMetric       prometheus.GaugeFunc
+	hitsMetric       prometheus.Counter
+	missesMetric     prometheus.Counter
+	replacedMetric   prometheus.Counter
+	evictedMetric    prometheus.Counter
+	expiredMetric    prometheus.Counter
+	pinnedMetric     prometheus.Gauge
+	tagsMetric       prometheus.GaugeFunc
+	tagEntriesMetric prometheus.GaugeFunc
+
+	// requests per operation, curried from the requests vector
+	requestsMetric  *prometheus.CounterVec
+	requestsMetrics [metricsOpsCount]prometheus.Counter
+
+	// segmented LRU metrics. Registered only when the cache uses segmented policy
+	probationMetric prometheus.GaugeFunc
+	protectedMetric prometheus.GaugeFunc
+	promotedMetric  prometheus.Counter
+	demotedMetric   prometheus.Counter
+
+	// priority class sizes. Registered only when the cache has several priority classes
+	priorityMetrics []prometheus.GaugeFunc
 }
 
 func newWithMetrics(
 	parent Cache,
+	baseCache *base,
+	registerer prometheus.Registerer,
 	namespace string,
 	subsystem string,
 	constLabels prometheus.Labels,
-) *lruWithMetrics {
+) (*lruWithMetrics, error) {
 	capacity := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
@@ -33,6 +111,28 @@ func newWithMetrics(
 	})
 	capacity.Set(float64(parent.Capacity()))
 
+	size := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_size",
+		Help:        "Number of items in cache",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		ret := 0
+		for i := range baseCache.policies {
+			ret += baseCache.PriorityLen(i)
+		}
+		return float64(ret)
+	})
+
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_requests_total",
+		Help:        "Total amount of cache requests by operation",
+		ConstLabels: constLabels,
+	}, []string{"op"})
+
 	hits := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
@@ -49,6 +149,14 @@ func newWithMetrics(
 		ConstLabels: constLabels,
 	})
 
+	replaced := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_replaced_total",
+		Help:        "Total amount of writes overwriting existing keys",
+		ConstLabels: constLabels,
+	})
+
 	evicted := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
@@ -65,100 +173,428 @@ func newWithMetrics(
 		ConstLabels: constLabels,
 	})
 
-	var target prometheus.AlreadyRegisteredError
+	pinned := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_pinned",
+		Help:        "Number of pinned keys",
+		ConstLabels: constLabels,
+	})
 
-	err := prometheus.Register(capacity)
-	if err != nil && !errors.As(err, &target) {
-		panic(err)
-	}
-	err = prometheus.Register(hits)
-	if err != nil && !errors.As(err, &target) {
-		panic(err)
-	}
-	err = prometheus.Register(misses)
-	if err != nil && !errors.As(err, &target) {
-		panic(err)
-	}
-	err = prometheus.Register(evicted)
-	if err != nil && !errors.As(err, &target) {
-		panic(err)
-	}
-	err = prometheus.Register(expired)
-	if err != nil && !errors.As(err, &target) {
-		panic(err)
-	}
+	tags := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_tags",
+		Help:        "Number of distinct tags in the tag index",
+		ConstLabels: constLabels,
+	}, func() float64 { return float64(baseCache.tags.TagsLen()) })
+
+	tagEntries := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_tag_entries",
+		Help:        "Number of key-tag pairs in the tag index",
+		ConstLabels: constLabels,
+	}, func() float64 { return float64(baseCache.tags.EntriesLen()) })
 
-	return &lruWithMetrics{
+	ret := &lruWithMetrics{
 		parent: parent,
 
+		registration: &metricsRegistration{registerer: registerer},
+
 		capacityMetric: capacity,
+		sizeMetric:     size,
 		hitsMetric:     hits,
 		missesMetric:   misses,
+		replacedMetric: replaced,
 		evictedMetric:  evicted,
 		expiredMetric:  expired,
+		pinnedMetric:   pinned,
+
+		tagsMetric:       tags,
+		tagEntriesMetric: tagEntries,
+
+		requestsMetric: requests,
+	}
+
+	for op := range metricsOpNames {
+		ret.requestsMetrics[op] = requests.WithLabelValues(metricsOpNames[op])
 	}
+
+	err := ret.registration.register(capacity, size, requests, hits, misses, replaced, evicted, expired, pinned, tags, tagEntries)
+	if err != nil {
+		ret.registration.unregister()
+		return nil, err
+	}
+
+	var segmented []*policySegmented
+	for _, p := range baseCache.policies {
+		if s, ok := p.(*policySegmented); ok {
+			segmented = append(segmented, s)
+		}
+	}
+
+	if len(segmented) > 0 {
+		if err := ret.registerSegmentedMetrics(segmented, namespace, subsystem, constLabels); err != nil {
+			ret.registration.unregister()
+			return nil, err
+		}
+	}
+
+	if len(baseCache.policies) > 1 {
+		if err := ret.registerPriorityMetrics(baseCache, namespace, subsystem, constLabels); err != nil {
+			ret.registration.unregister()
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (c *lruWithMetrics) registerSegmentedMetrics(
+	segmented []*policySegmented,
+	namespace string,
+	subsystem string,
+	constLabels prometheus.Labels,
+) error {
+	probation := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_probation_size",
+		Help:        "Number of items in the probation segment",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		ret := 0
+		for i := range segmented {
+			ret += segmented[i].ProbationLen()
+		}
+		return float64(ret)
+	})
+
+	protected := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_protected_size",
+		Help:        "Number of items in the protected segment",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		ret := 0
+		for i := range segmented {
+			ret += segmented[i].ProtectedLen()
+		}
+		return float64(ret)
+	})
+
+	promoted := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_promoted_total",
+		Help:        "Total amount of keys promoted to the protected segment",
+		ConstLabels: constLabels,
+	})
+
+	demoted := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_demoted_total",
+		Help:        "Total amount of keys demoted to the probation segment",
+		ConstLabels: constLabels,
+	})
+
+	if err := c.registration.register(probation, protected, promoted, demoted); err != nil {
+		return err
+	}
+
+	c.probationMetric = probation
+	c.protectedMetric = protected
+	c.promotedMetric = promoted
+	c.demotedMetric = demoted
+
+	return nil
+}
+
+func (c *lruWithMetrics) registerPriorityMetrics(
+	baseCache *base,
+	namespace string,
+	subsystem string,
+	constLabels prometheus.Labels,
+) error {
+	for i := range baseCache.policies {
+		priority := i
+
+		labels := prometheus.Labels{"priority": strconv.Itoa(priority)}
+		for k, v := range constLabels {
+			labels[k] = v
+		}
+
+		size := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "cache_priority_size",
+			Help:        "Number of items in the priority class",
+			ConstLabels: labels,
+		}, func() float64 { return float64(baseCache.PriorityLen(priority)) })
+
+		if err := c.registration.register(size); err != nil {
+			return err
+		}
+
+		c.priorityMetrics = append(c.priorityMetrics, size)
+	}
+
+	return nil
+}
+
+// registerLatencyMetrics registers histograms of lock wait and operation time.
+// The returned recorder must be set to the sync wrapper
+func (c *lruWithMetrics) registerLatencyMetrics(
+	buckets []float64,
+	sampleRate float64,
+	namespace string,
+	subsystem string,
+	constLabels prometheus.Labels,
+) (*latencyRecorder, error) {
+	lockWait := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_lock_wait_seconds",
+		Help:        "Time spent waiting for the cache lock",
+		ConstLabels: constLabels,
+		Buckets:     buckets,
+	}, []string{"op"})
+
+	operation := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_operation_seconds",
+		Help:        "Time spent holding the cache lock",
+		ConstLabels: constLabels,
+		Buckets:     buckets,
+	}, []string{"op"})
+
+	if err := c.registration.register(lockWait, operation); err != nil {
+		return nil, err
+	}
+
+	return newLatencyRecorder(sampleRate, lockWait, operation), nil
 }
 
 func (c *lruWithMetrics) Capacity() int {
 	return c.parent.Capacity()
 }
 
-func (c *lruWithMetrics) Exists(key string) bool {
-	exists := c.parent.Exists(key)
-	if exists {
-		c.hitsMetric.Inc()
-	} else {
-		c.missesMetric.Inc()
-	}
+func (c *lruWithMetrics) Resize(capacity int) {
+	c.parent.Resize(capacity)
+	c.capacityMetric.Set(float64(c.parent.Capacity()))
+}
+
+func (c *lruWithMetrics) Len() int {
+	return c.parent.Len()
+}
+
+func (c *lruWithMetrics) Keys() []string {
+	return c.parent.Keys()
+}
+
+func (c *lruWithMetrics) Range(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.parent.Range(fn)
+}
+
+func (c *lruWithMetrics) RangeReverse(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.parent.RangeReverse(fn)
+}
 
-	return exists
+// Exists doesn't count as hit or miss
+func (c *lruWithMetrics) Exists(key string) bool {
+	c.requestsMetrics[metricsOpExists].Inc()
+	return c.parent.Exists(key)
 }
 
 func (c *lruWithMetrics) Set(key string, value interface{}) {
+	c.requestsMetrics[metricsOpSet].Inc()
 	c.parent.Set(key, value)
 }
 
-func (c *lruWithMetrics) Delete(key string) bool {
-	deleted := c.parent.Delete(key)
-	if deleted {
-		c.hitsMetric.Inc()
-	} else {
-		c.missesMetric.Inc()
-	}
+func (c *lruWithMetrics) SetPinned(key string, value interface{}) bool {
+	c.requestsMetrics[metricsOpSet].Inc()
+	return c.parent.SetPinned(key, value)
+}
 
-	return deleted
+func (c *lruWithMetrics) SetWithPriority(key string, value interface{}, priority int) {
+	c.requestsMetrics[metricsOpSet].Inc()
+	c.parent.SetWithPriority(key, value, priority)
+}
+
+func (c *lruWithMetrics) SetWithTags(key string, value interface{}, tags ...string) {
+	c.requestsMetrics[metricsOpSet].Inc()
+	c.parent.SetWithTags(key, value, tags...)
+}
+
+func (c *lruWithMetrics) InvalidateTag(tag string) int {
+	return c.parent.InvalidateTag(tag)
+}
+
+func (c *lruWithMetrics) Pin(key string) bool {
+	return c.parent.Pin(key)
+}
+
+func (c *lruWithMetrics) Unpin(key string) bool {
+	return c.parent.Unpin(key)
+}
+
+// Delete doesn't count as hit or miss
+func (c *lruWithMetrics) Delete(key string) bool {
+	c.requestsMetrics[metricsOpDelete].Inc()
+	return c.parent.Delete(key)
 }
 
 func (c *lruWithMetrics) Get(key string) (interface{}, bool) {
+	c.requestsMetrics[metricsOpGet].Inc()
+
 	ret, found := c.parent.Get(key)
-	if found {
-		c.hitsMetric.Inc()
-	} else {
-		c.missesMetric.Inc()
-	}
+	c.lookup(found)
 
 	return ret, found
 }
 
+// Peek is not counted, neither as request nor as hit or miss
+func (c *lruWithMetrics) Peek(key string) (interface{}, bool) {
+	return c.parent.Peek(key)
+}
+
+func (c *lruWithMetrics) Touch(key string) bool {
+	c.requestsMetrics[metricsOpTouch].Inc()
+	return c.parent.Touch(key)
+}
+
+func (c *lruWithMetrics) TouchWithTTL(key string, ttl time.Duration) bool {
+	c.requestsMetrics[metricsOpTouch].Inc()
+	return c.parent.TouchWithTTL(key, ttl)
+}
+
+func (c *lruWithMetrics) GetOrSet(key string, value interface{}) (interface{}, bool) {
+	c.requestsMetrics[metricsOpGetOrSet].Inc()
+
+	ret, loaded := c.parent.GetOrSet(key, value)
+	c.lookup(loaded)
+
+	return ret, loaded
+}
+
+func (c *lruWithMetrics) GetOrLoad(key string, load func(key string) (interface{}, error)) (interface{}, error) {
+	c.requestsMetrics[metricsOpGetOrLoad].Inc()
+
+	var loaded bool
+
+	ret, err := c.parent.GetOrLoad(key, func(key string) (interface{}, error) {
+		loaded = true
+		return load(key)
+	})
+	c.lookup(!loaded)
+
+	return ret, err
+}
+
+func (c *lruWithMetrics) Compute(key string, fn func(old interface{}, exists bool) (interface{}, bool)) (interface{}, bool) {
+	c.requestsMetrics[metricsOpCompute].Inc()
+
+	var existed bool
+
+	ret, ok := c.parent.Compute(key, func(old interface{}, exists bool) (interface{}, bool) {
+		existed = exists
+		return fn(old, exists)
+	})
+	c.lookup(existed)
+
+	return ret, ok
+}
+
+// CompareAndSwap is a conditional write, it doesn't count as hit or miss
+func (c *lruWithMetrics) CompareAndSwap(key string, old, new interface{}) bool {
+	c.requestsMetrics[metricsOpCompareAndSwap].Inc()
+	return c.parent.CompareAndSwap(key, old, new)
+}
+
+// CompareAndDelete is a conditional write, it doesn't count as hit or miss
+func (c *lruWithMetrics) CompareAndDelete(key string, old interface{}) bool {
+	c.requestsMetrics[metricsOpCompareAndDelete].Inc()
+	return c.parent.CompareAndDelete(key, old)
+}
+
+// GetMany counts a request per call and a hit or miss per key
+func (c *lruWithMetrics) GetMany(keys []string) ([]interface{}, []bool) {
+	c.requestsMetrics[metricsOpGetMany].Inc()
+
+	values, found := c.parent.GetMany(keys)
+
+	hits := 0
+	for i := range found {
+		if found[i] {
+			hits++
+		}
+	}
+
+	c.hitsMetric.Add(float64(hits))
+	c.missesMetric.Add(float64(len(keys) - hits))
+
+	return values, found
+}
+
+func (c *lruWithMetrics) SetMany(items map[string]interface{}) {
+	c.requestsMetrics[metricsOpSetMany].Inc()
+	c.parent.SetMany(items)
+}
+
+func (c *lruWithMetrics) DeleteMany(keys []string) int {
+	c.requestsMetrics[metricsOpDeleteMany].Inc()
+	return c.parent.DeleteMany(keys)
+}
+
+func (c *lruWithMetrics) DeleteByPrefix(prefix string) int {
+	return c.parent.DeleteByPrefix(prefix)
+}
+
+func (c *lruWithMetrics) DeleteFunc(fn func(key string, value interface{}) bool) int {
+	return c.parent.DeleteFunc(fn)
+}
+
+func (c *lruWithMetrics) Purge() {
+	c.parent.Purge()
+}
+
+func (c *lruWithMetrics) PurgeWithCallbacks() {
+	c.parent.PurgeWithCallbacks()
+}
+
+// TTL doesn't count as hit or miss
 func (c *lruWithMetrics) TTL(key string) (time.Duration, bool) {
-	ttl, found := c.parent.TTL(key)
-	if found {
+	c.requestsMetrics[metricsOpTTL].Inc()
+	return c.parent.TTL(key)
+}
+
+func (c *lruWithMetrics) Stats() Stats {
+	return c.parent.Stats()
+}
+
+func (c *lruWithMetrics) TopKeys(n int) []HotKey {
+	return c.parent.TopKeys(n)
+}
+
+func (c *lruWithMetrics) Destroy() {
+	c.registration.unregister()
+	c.parent.Destroy()
+}
+
+func (c *lruWithMetrics) lookup(hit bool) {
+	if hit {
 		c.hitsMetric.Inc()
 	} else {
 		c.missesMetric.Inc()
 	}
-
-	return ttl, found
 }
 
-func (c *lruWithMetrics) Destroy() {
-	prometheus.Unregister(c.capacityMetric)
-	prometheus.Unregister(c.hitsMetric)
-	prometheus.Unregister(c.missesMetric)
-	prometheus.Unregister(c.evictedMetric)
-	prometheus.Unregister(c.expiredMetric)
-
-	c.parent.Destroy()
+func (c *lruWithMetrics) onReplace(string) {
+	c.replacedMetric.Inc()
 }
 
 func (c *lruWithMetrics) onEvict(string) {
@@ -168,3 +604,19 @@ func (c *lruWithMetrics) onEvict(string) {
 func (c *lruWithMetrics) onExpire(string) {
 	c.expiredMetric.Inc()
 }
+
+func (c *lruWithMetrics) onPin(string) {
+	c.pinnedMetric.Inc()
+}
+
+func (c *lruWithMetrics) onUnpin(string) {
+	c.pinnedMetric.Dec()
+}
+
+func (c *lruWithMetrics) onPromote(string) {
+	c.promotedMetric.Inc()
+}
+
+func (c *lruWithMetrics) onDemote(string) {
+	c.demotedMetric.Inc()
+}
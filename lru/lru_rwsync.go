@@ -0,0 +1,321 @@
+package lru
+
+import (
+	"sync"
+	"time"
+)
+
+// lruWithRWSync is a wrapper for cache that allows concurrent access to the cache.
+// Unlike lruWithSync, read operations are executed under a shared lock,
+// so it must only wrap caches whose read operations don't modify the cache.
+// When the policy can't be updated under a shared lock, reads are recorded into the read buffer,
+// which is drained under the exclusive lock on writes or when it fills up.
+type lruWithRWSync struct {
+	parent Cache
+	buffer *readBuffer
+
+	// latency is set when latency histograms are enabled. Optional
+	latency *latencyRecorder
+
+	sync.RWMutex
+}
+
+func newWithRWSync(parent Cache, buffer *readBuffer, latency *latencyRecorder) *lruWithRWSync {
+	return &lruWithRWSync{parent: parent, buffer: buffer, latency: latency}
+}
+
+// lock takes the exclusive lock and applies buffered reads
+func (c *lruWithRWSync) lock() {
+	c.Lock()
+	if c.buffer != nil {
+		c.buffer.drain()
+	}
+}
+
+// runlock releases the shared lock and drains the read buffer if it fills up
+func (c *lruWithRWSync) runlock() {
+	c.RUnlock()
+
+	if c.buffer != nil && c.buffer.acquireDrain() {
+		c.Lock()
+		c.buffer.drain()
+		c.Unlock()
+	}
+}
+
+func (c *lruWithRWSync) Capacity() int {
+	c.RLock()
+	ret := c.parent.Capacity()
+	c.runlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) Resize(capacity int) {
+	c.lock()
+	c.parent.Resize(capacity)
+	c.Unlock()
+}
+
+func (c *lruWithRWSync) Len() int {
+	c.RLock()
+	ret := c.parent.Len()
+	c.runlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) Keys() []string {
+	c.RLock()
+	ret := c.parent.Keys()
+	c.runlock()
+
+	return ret
+}
+
+// Range holds the lock during the whole walk, so fn must not access the cache
+func (c *lruWithRWSync) Range(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.RLock()
+	c.parent.Range(fn)
+	c.runlock()
+}
+
+// RangeReverse holds the lock during the whole walk, so fn must not access the cache
+func (c *lruWithRWSync) RangeReverse(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.RLock()
+	c.parent.RangeReverse(fn)
+	c.runlock()
+}
+
+func (c *lruWithRWSync) Exists(key string) bool {
+	c.RLock()
+	ret := c.parent.Exists(key)
+	c.runlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) Set(key string, value interface{}) {
+	timer := c.latency.start()
+	c.lock()
+	timer.locked()
+	c.parent.Set(key, value)
+	c.Unlock()
+	timer.done(latencyOpSet)
+}
+
+func (c *lruWithRWSync) SetPinned(key string, value interface{}) bool {
+	c.lock()
+	ret := c.parent.SetPinned(key, value)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) SetWithPriority(key string, value interface{}, priority int) {
+	c.lock()
+	c.parent.SetWithPriority(key, value, priority)
+	c.Unlock()
+}
+
+func (c *lruWithRWSync) SetWithTags(key string, value interface{}, tags ...string) {
+	c.lock()
+	c.parent.SetWithTags(key, value, tags...)
+	c.Unlock()
+}
+
+func (c *lruWithRWSync) InvalidateTag(tag string) int {
+	c.lock()
+	ret := c.parent.InvalidateTag(tag)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) Pin(key string) bool {
+	c.lock()
+	ret := c.parent.Pin(key)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) Unpin(key string) bool {
+	c.lock()
+	ret := c.parent.Unpin(key)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) Delete(key string) bool {
+	timer := c.latency.start()
+	c.lock()
+	timer.locked()
+	ret := c.parent.Delete(key)
+	c.Unlock()
+	timer.done(latencyOpDelete)
+
+	return ret
+}
+
+func (c *lruWithRWSync) Get(key string) (interface{}, bool) {
+	timer := c.latency.start()
+	c.RLock()
+	timer.locked()
+	val, ok := c.parent.Get(key)
+	c.runlock()
+	timer.done(latencyOpGet)
+
+	return val, ok
+}
+
+func (c *lruWithRWSync) Peek(key string) (interface{}, bool) {
+	c.RLock()
+	val, ok := c.parent.Peek(key)
+	c.runlock()
+
+	return val, ok
+}
+
+func (c *lruWithRWSync) Touch(key string) bool {
+	c.lock()
+	ret := c.parent.Touch(key)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) TouchWithTTL(key string, ttl time.Duration) bool {
+	c.lock()
+	ret := c.parent.TouchWithTTL(key, ttl)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) GetOrSet(key string, value interface{}) (interface{}, bool) {
+	c.lock()
+	val, loaded := c.parent.GetOrSet(key, value)
+	c.Unlock()
+
+	return val, loaded
+}
+
+// GetOrLoad releases the lock while load runs, so other operations don't wait for it.
+// Concurrent calls for the same missing key each call load, the last loaded value is stored
+func (c *lruWithRWSync) GetOrLoad(key string, load func(key string) (interface{}, error)) (interface{}, error) {
+	c.lock()
+	// load is called unlocked and the lock is taken back even if it panics, so the deferred unlock is always paired
+	defer c.Unlock()
+
+	return c.parent.GetOrLoad(key, func(key string) (interface{}, error) {
+		c.Unlock()
+		defer c.lock()
+
+		return load(key)
+	})
+}
+
+// Compute calls fn under the lock, so fn must not access the cache
+func (c *lruWithRWSync) Compute(key string, fn func(old interface{}, exists bool) (interface{}, bool)) (interface{}, bool) {
+	c.lock()
+	val, ok := c.parent.Compute(key, fn)
+	c.Unlock()
+
+	return val, ok
+}
+
+func (c *lruWithRWSync) CompareAndSwap(key string, old, new interface{}) bool {
+	c.lock()
+	ret := c.parent.CompareAndSwap(key, old, new)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) CompareAndDelete(key string, old interface{}) bool {
+	c.lock()
+	ret := c.parent.CompareAndDelete(key, old)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) GetMany(keys []string) ([]interface{}, []bool) {
+	c.RLock()
+	values, found := c.parent.GetMany(keys)
+	c.runlock()
+
+	return values, found
+}
+
+func (c *lruWithRWSync) SetMany(items map[string]interface{}) {
+	c.lock()
+	c.parent.SetMany(items)
+	c.Unlock()
+}
+
+func (c *lruWithRWSync) DeleteMany(keys []string) int {
+	c.lock()
+	ret := c.parent.DeleteMany(keys)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) DeleteByPrefix(prefix string) int {
+	c.lock()
+	ret := c.parent.DeleteByPrefix(prefix)
+	c.Unlock()
+
+	return ret
+}
+
+// DeleteFunc calls fn under the lock, so fn must not access the cache
+func (c *lruWithRWSync) DeleteFunc(fn func(key string, value interface{}) bool) int {
+	c.lock()
+	ret := c.parent.DeleteFunc(fn)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithRWSync) Purge() {
+	c.lock()
+	c.parent.Purge()
+	c.Unlock()
+}
+
+func (c *lruWithRWSync) PurgeWithCallbacks() {
+	c.lock()
+	c.parent.PurgeWithCallbacks()
+	c.Unlock()
+}
+
+func (c *lruWithRWSync) TTL(key string) (time.Duration, bool) {
+	c.RLock()
+	val, ok := c.parent.TTL(key)
+	c.runlock()
+
+	return val, ok
+}
+
+func (c *lruWithRWSync) Stats() Stats {
+	c.RLock()
+	ret := c.parent.Stats()
+	c.runlock()
+
+	return ret
+}
+
+// TopKeys doesn't take the lock, hot keys are tracked outside of it
+func (c *lruWithRWSync) TopKeys(n int) []HotKey {
+	return c.parent.TopKeys(n)
+}
+
+func (c *lruWithRWSync) Destroy() {
+	c.lock()
+	c.parent.Destroy()
+	c.Unlock()
+}
@@ -9,11 +9,14 @@ import (
 type lruWithSync struct {
 	parent Cache
 
+	// latency is set when latency histograms are enabled. Optional
+	latency *latencyRecorder
+
 	sync.Mutex
 }
 
-func newWithSync(parent Cache) *lruWithSync {
-	return &lruWithSync{parent: parent}
+func newWithSync(parent Cache, latency *latencyRecorder) *lruWithSync {
+	return &lruWithSync{parent: parent, latency: latency}
 }
 
 func (c *lruWithSync) Capacity() int {
@@ -24,6 +27,42 @@ func (c *lruWithSync) Capacity() int {
 	return ret
 }
 
+func (c *lruWithSync) Resize(capacity int) {
+	c.Lock()
+	c.parent.Resize(capacity)
+	c.Unlock()
+}
+
+func (c *lruWithSync) Len() int {
+	c.Lock()
+	ret := c.parent.Len()
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) Keys() []string {
+	c.Lock()
+	ret := c.parent.Keys()
+	c.Unlock()
+
+	return ret
+}
+
+// Range holds the lock during the whole walk, so fn must not access the cache
+func (c *lruWithSync) Range(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.Lock()
+	c.parent.Range(fn)
+	c.Unlock()
+}
+
+// RangeReverse holds the lock during the whole walk, so fn must not access the cache
+func (c *lruWithSync) RangeReverse(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.Lock()
+	c.parent.RangeReverse(fn)
+	c.Unlock()
+}
+
 func (c *lruWithSync) Exists(key string) bool {
 	c.Lock()
 	ret := c.parent.Exists(key)
@@ -33,27 +72,203 @@ func (c *lruWithSync) Exists(key string) bool {
 }
 
 func (c *lruWithSync) Set(key string, value interface{}) {
+	timer := c.latency.start()
 	c.Lock()
+	timer.locked()
 	c.parent.Set(key, value)
 	c.Unlock()
+	timer.done(latencyOpSet)
+}
+
+func (c *lruWithSync) SetPinned(key string, value interface{}) bool {
+	c.Lock()
+	ret := c.parent.SetPinned(key, value)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) SetWithPriority(key string, value interface{}, priority int) {
+	c.Lock()
+	c.parent.SetWithPriority(key, value, priority)
+	c.Unlock()
+}
+
+func (c *lruWithSync) SetWithTags(key string, value interface{}, tags ...string) {
+	c.Lock()
+	c.parent.SetWithTags(key, value, tags...)
+	c.Unlock()
+}
+
+func (c *lruWithSync) InvalidateTag(tag string) int {
+	c.Lock()
+	ret := c.parent.InvalidateTag(tag)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) Pin(key string) bool {
+	c.Lock()
+	ret := c.parent.Pin(key)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) Unpin(key string) bool {
+	c.Lock()
+	ret := c.parent.Unpin(key)
+	c.Unlock()
+
+	return ret
 }
 
 func (c *lruWithSync) Delete(key string) bool {
+	timer := c.latency.start()
 	c.Lock()
+	timer.locked()
 	ret := c.parent.Delete(key)
 	c.Unlock()
+	timer.done(latencyOpDelete)
 
 	return ret
 }
 
 func (c *lruWithSync) Get(key string) (interface{}, bool) {
+	timer := c.latency.start()
 	c.Lock()
+	timer.locked()
 	val, ok := c.parent.Get(key)
 	c.Unlock()
+	timer.done(latencyOpGet)
+
+	return val, ok
+}
+
+func (c *lruWithSync) Peek(key string) (interface{}, bool) {
+	c.Lock()
+	val, ok := c.parent.Peek(key)
+	c.Unlock()
+
+	return val, ok
+}
+
+func (c *lruWithSync) Touch(key string) bool {
+	c.Lock()
+	ret := c.parent.Touch(key)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) TouchWithTTL(key string, ttl time.Duration) bool {
+	c.Lock()
+	ret := c.parent.TouchWithTTL(key, ttl)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) GetOrSet(key string, value interface{}) (interface{}, bool) {
+	c.Lock()
+	val, loaded := c.parent.GetOrSet(key, value)
+	c.Unlock()
+
+	return val, loaded
+}
+
+// GetOrLoad releases the lock while load runs, so other operations don't wait for it.
+// Concurrent calls for the same missing key each call load, the last loaded value is stored
+func (c *lruWithSync) GetOrLoad(key string, load func(key string) (interface{}, error)) (interface{}, error) {
+	c.Lock()
+	// load is called unlocked and the lock is taken back even if it panics, so the deferred unlock is always paired
+	defer c.Unlock()
+
+	return c.parent.GetOrLoad(key, func(key string) (interface{}, error) {
+		c.Unlock()
+		defer c.Lock()
+
+		return load(key)
+	})
+}
+
+// Compute calls fn under the lock, so fn must not access the cache
+func (c *lruWithSync) Compute(key string, fn func(old interface{}, exists bool) (interface{}, bool)) (interface{}, bool) {
+	c.Lock()
+	val, ok := c.parent.Compute(key, fn)
+	c.Unlock()
 
 	return val, ok
 }
 
+func (c *lruWithSync) CompareAndSwap(key string, old, new interface{}) bool {
+	c.Lock()
+	ret := c.parent.CompareAndSwap(key, old, new)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) CompareAndDelete(key string, old interface{}) bool {
+	c.Lock()
+	ret := c.parent.CompareAndDelete(key, old)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) GetMany(keys []string) ([]interface{}, []bool) {
+	c.Lock()
+	values, found := c.parent.GetMany(keys)
+	c.Unlock()
+
+	return values, found
+}
+
+func (c *lruWithSync) SetMany(items map[string]interface{}) {
+	c.Lock()
+	c.parent.SetMany(items)
+	c.Unlock()
+}
+
+func (c *lruWithSync) DeleteMany(keys []string) int {
+	c.Lock()
+	ret := c.parent.DeleteMany(keys)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) DeleteByPrefix(prefix string) int {
+	c.Lock()
+	ret := c.parent.DeleteByPrefix(prefix)
+	c.Unlock()
+
+	return ret
+}
+
+// DeleteFunc calls fn under the lock, so fn must not access the cache
+func (c *lruWithSync) DeleteFunc(fn func(key string, value interface{}) bool) int {
+	c.Lock()
+	ret := c.parent.DeleteFunc(fn)
+	c.Unlock()
+
+	return ret
+}
+
+func (c *lruWithSync) Purge() {
+	c.Lock()
+	c.parent.Purge()
+	c.Unlock()
+}
+
+func (c *lruWithSync) PurgeWithCallbacks() {
+	c.Lock()
+	c.parent.PurgeWithCallbacks()
+	c.Unlock()
+}
+
 func (c *lruWithSync) TTL(key string) (time.Duration, bool) {
 	c.Lock()
 	val, ok := c.parent.TTL(key)
@@ -62,6 +277,21 @@ func (c *lruWithSync) TTL(key string) (time.Duration, bool) {
 	return val, ok
 }
 
+func (c *lruWithSync) Stats() Stats {
+	c.Lock()
+	ret := c.parent.Stats()
+	c.Unlock()
+
+	return ret
+}
+
+// TopKeys doesn't take the lock, hot keys are tracked outside of it
+func (c *lruWithSync) TopKeys(n int) []HotKey {
+	return c.parent.TopKeys(n)
+}
+
 func (c *lruWithSync) Destroy() {
+	c.Lock()
 	c.parent.Destroy()
+	c.Unlock()
 }
@@ -1,10 +1,23 @@
 package lru
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/pavel-krush/cache/v2/lru/lrutest"
+	"github.com/pavel-krush/cache/v2/lru/trace"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func key(i int) string {
@@ -74,8 +87,9 @@ func Test_LRU_base_eviction(t *testing.T) {
 func Test_LRU_base_expiration(t *testing.T) {
 	capacity := 10
 	ttl := time.Millisecond * 50
+	clock := lrutest.NewFakeClock(time.Now())
 
-	c := New().WithCapacity(capacity).WithTTL(ttl).Build()
+	c := New().WithCapacity(capacity).WithTTL(ttl).WithClock(clock).Build()
 
 	for i := 0; i < capacity; i++ {
 		c.Set(key(i), value(i))
@@ -87,7 +101,7 @@ func Test_LRU_base_expiration(t *testing.T) {
 		}
 	}
 
-	time.Sleep(ttl)
+	clock.Advance(ttl * 2)
 
 	for i := 0; i < capacity; i++ {
 		if _, found := c.Get(key(i)); found {
@@ -96,56 +110,1700 @@ func Test_LRU_base_expiration(t *testing.T) {
 	}
 }
 
-const accessKeysSize = 1000000
+func Test_LRU_base_expiration_precise_clock(t *testing.T) {
+	ttl := time.Millisecond * 20
 
-func BenchmarkMapNoExpiration(b *testing.B) {
-	cache := make(map[string]int)
-	var keys []string
-	var accessKeys = make([]string, accessKeysSize)
-	for i := 0; i < 10000; i++ {
-		k := randomWord(10)
-		keys = append(keys, k)
-		cache[k] = rand.Intn(1024)
+	c := New().WithCapacity(10).WithTTL(ttl).Build()
+	if _, ok := c.(*base).clock.(*ClockPrecise); !ok {
+		t.Fatalf("expected precise clock by default, got %T", c.(*base).clock)
 	}
 
-	for i := 0; i < accessKeysSize; i++ {
-		accessKeys[i] = keys[rand.Intn(len(keys))]
+	c.Set(key(0), value(0))
+	if _, found := c.Get(key(0)); !found {
+		t.Errorf("expected key \"%s\" in cache", key(0))
 	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, _ = cache[accessKeys[i%accessKeysSize]]
+	time.Sleep(ttl * 2)
+
+	if _, found := c.Get(key(0)); found {
+		t.Errorf("expected key \"%s\" expired", key(0))
 	}
 }
 
-func benchmarkLru(b *testing.B, cache Cache) {
-	var keys []string
-	var accessKeys = make([]string, accessKeysSize)
-	for i := 0; i < 10000; i++ {
-		k := randomWord(10)
-		keys = append(keys, k)
-		cache.Set(k, rand.Intn(1024))
+func Test_LRU_read_buffer_hot_item(t *testing.T) {
+	applied := 0
+	buffer := newReadBuffer(func(*item) { applied++ })
+
+	// accesses of one item are spread over stripes instead of filling a single one
+	it := &item{key: key(0)}
+	for i := 0; i < readBufferStripeSize*2; i++ {
+		buffer.record(it)
 	}
+	buffer.drain()
 
-	for i := 0; i < accessKeysSize; i++ {
-		accessKeys[i] = keys[rand.Intn(len(keys))]
+	if applied <= readBufferStripeSize {
+		t.Errorf("expected more than %d accesses applied, got %d", readBufferStripeSize, applied)
 	}
+}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		cache.Get(accessKeys[i%accessKeysSize])
+func Test_LRU_second_chance_concurrent(t *testing.T) {
+	capacity := 100
+
+	c := New().WithCapacity(capacity).WithSync().WithSecondChance().Build()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if g == 0 {
+					c.Set(key(i%(capacity*2)), value(i))
+				} else {
+					c.Get(key(i % (capacity * 2)))
+				}
+			}
+		}(g)
 	}
+	wg.Wait()
 }
 
-func BenchmarkLRUNoExpiration(b *testing.B) {
-	cache := New().
-		WithCapacity(10000).
-		WithTTL(time.Hour).
+func Test_LRU_concurrent_reads(t *testing.T) {
+	capacity := 100
+
+	builders := map[string]Builder{
+		"lru":       New(),
+		"segmented": New().WithSegmentedLRU(0.5),
+	}
+
+	for name, builder := range builders {
+		c := builder.WithCapacity(capacity).WithTTL(time.Minute).WithSync().WithConcurrentReads().Build()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					k := key(i % (capacity * 2))
+					switch {
+					case g == 0:
+						c.Set(k, value(i))
+					case g == 1 && i%10 == 0:
+						c.Delete(k)
+					case g == 2 && i%100 == 0:
+						c.Range(func(string, interface{}, time.Time) bool { return true })
+					default:
+						c.Get(k)
+						c.Exists(k)
+						c.TTL(k)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		if c.Len() > capacity {
+			t.Errorf("%s: expected at most %d keys, got %d", name, capacity, c.Len())
+		}
+	}
+}
+
+func Test_LRU_concurrent_reads_promotion(t *testing.T) {
+	capacity := 10
+
+	c := New().WithCapacity(capacity).WithSegmentedLRU(0.5).WithSync().WithConcurrentReads().Build()
+
+	// reads are buffered and must be applied before the scan evicts anything
+	for i := 0; i < 5; i++ {
+		c.Set(key(i), value(i))
+		c.Get(key(i))
+	}
+
+	for i := 100; i < 200; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	for i := 0; i < 5; i++ {
+		if !c.Exists(key(i)) {
+			t.Errorf("expected protected key \"%s\" to survive the scan", key(i))
+		}
+	}
+}
+
+func Test_LRU_metrics_registerer(t *testing.T) {
+	build := func(registry *prometheus.Registry) Cache {
+		return New().WithCapacity(10).WithMetrics("test", "lru", prometheus.Labels{"name": "cache"}).
+			WithMetricsRegisterer(registry).Build()
+	}
+
+	// caches with the same labels don't share metrics when registered in different registries
+	registry1, registry2 := prometheus.NewRegistry(), prometheus.NewRegistry()
+	c1, c2 := build(registry1), build(registry2)
+
+	c1.Set(key(1), value(1))
+	c1.Get(key(1))
+	c2.Get(key(1))
+
+	expected := map[*prometheus.Registry]string{
+		registry1: `
+# HELP test_lru_cache_hits_total Total amount of cache hits
+# TYPE test_lru_cache_hits_total counter
+test_lru_cache_hits_total{name="cache"} 1
+`,
+		registry2: `
+# HELP test_lru_cache_hits_total Total amount of cache hits
+# TYPE test_lru_cache_hits_total counter
+test_lru_cache_hits_total{name="cache"} 0
+`,
+	}
+
+	for registry, text := range expected {
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(text), "test_lru_cache_hits_total"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	c1.Destroy()
+	c2.Destroy()
+
+	if count, _ := testutil.GatherAndCount(registry1); count != 0 {
+		t.Errorf("expected all metrics to be unregistered, got %d", count)
+	}
+}
+
+func Test_LRU_metrics_semantics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c := New().WithCapacity(10).WithMetrics("test", "lru", nil).WithMetricsRegisterer(registry).Build()
+
+	c.Set(key(1), value(1))
+	c.Set(key(1), value(2))
+	c.Get(key(1))
+	c.Get(key(2))
+	c.GetMany([]string{key(1), key(2), key(3)})
+
+	// lookups that are not reads don't count as hits or misses
+	c.Exists(key(1))
+	c.TTL(key(2))
+	c.Delete(key(3))
+	c.Peek(key(1))
+
+	expected := `
+# HELP test_lru_cache_hits_total Total amount of cache hits
+# TYPE test_lru_cache_hits_total counter
+test_lru_cache_hits_total 2
+# HELP test_lru_cache_misses_total Total amount of cache misses
+# TYPE test_lru_cache_misses_total counter
+test_lru_cache_misses_total 3
+# HELP test_lru_cache_replaced_total Total amount of writes overwriting existing keys
+# TYPE test_lru_cache_replaced_total counter
+test_lru_cache_replaced_total 1
+# HELP test_lru_cache_size Number of items in cache
+# TYPE test_lru_cache_size gauge
+test_lru_cache_size 1
+`
+	names := []string{"test_lru_cache_hits_total", "test_lru_cache_misses_total", "test_lru_cache_replaced_total", "test_lru_cache_size"}
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+
+	// peek is not counted
+	if count := testutil.CollectAndCount(c.(*lruWithMetrics).requestsMetric); count != int(metricsOpsCount) {
+		t.Errorf("expected %d request series, got %d", metricsOpsCount, count)
+	}
+
+	requests := map[string]float64{"get": 2, "get_many": 1, "set": 2, "exists": 1, "ttl": 1, "delete": 1, "compute": 0}
+	for op, value := range requests {
+		if got := testutil.ToFloat64(c.(*lruWithMetrics).requestsMetric.WithLabelValues(op)); got != value {
+			t.Errorf("expected %v %s requests, got %v", value, op, got)
+		}
+	}
+
+	c.Destroy()
+
+	// disabled metrics are not registered
+	c = NewFromConfig(&Config{Capacity: 10, Metrics: &MetricsConfig{Enabled: false, Registerer: registry}}).Build()
+	if count, _ := testutil.GatherAndCount(registry); count != 0 {
+		t.Errorf("expected no metrics when disabled, got %d", count)
+	}
+	c.Destroy()
+}
+
+func Test_LRU_build_errors(t *testing.T) {
+	cases := map[string]struct {
+		builder Builder
+		option  string
+	}{
+		"no capacity":        {New(), "WithCapacity"},
+		"negative ttl":       {New().WithCapacity(10).WithTTL(-time.Second), "WithTTL"},
+		"duplicated option":  {New().WithCapacity(10).WithSync().WithSync(), "WithSync"},
+		"first duplicate":    {New().WithCapacity(10).WithTTL(1).WithTTL(2).WithSync().WithSync(), "WithTTL"},
+		"reads without sync": {New().WithCapacity(10).WithConcurrentReads(), "WithConcurrentReads"},
+		"invalid config":     {NewFromConfig(&Config{Capacity: 10, ConcurrentReads: true}), "NewFromConfig"},
+		"empty config":       {NewFromConfig(nil), "NewFromConfig"},
+	}
+
+	for name, tc := range cases {
+		_, err := tc.builder.BuildE()
+
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			t.Errorf("%s: expected config error, got %v", name, err)
+			continue
+		}
+
+		if configErr.Option != tc.option {
+			t.Errorf("%s: expected error of %s, got %s", name, tc.option, configErr)
+		}
+	}
+
+	// Build panics with the same error
+	func() {
+		defer func() {
+			if _, ok := recover().(*ConfigError); !ok {
+				t.Error("expected Build to panic with config error")
+			}
+		}()
+		New().WithCapacity(10).WithSync().WithSync().Build()
+	}()
+}
+
+func Test_LRU_use_after_destroy(t *testing.T) {
+	builders := map[string]Builder{
+		"lru":              New(),
+		"sync":             New().WithSync(),
+		"concurrent reads": New().WithSync().WithConcurrentReads().WithSegmentedLRU(0.5),
+		"second chance":    New().WithSync().WithSecondChance(),
+		"metrics":          New().WithMetrics("test", "lru", nil).WithMetricsRegisterer(prometheus.NewRegistry()),
+		"trace":            New().WithTraceRecorder(io.Discard, 1),
+		"hot keys":         New().WithHotKeys(HotKeysConfig{}),
+		"prefix and tags":  New().WithPrefixIndex().WithPriorities(2),
+		"memory":           New().WithSync().WithMemoryController(MemoryControllerConfig{MinCapacity: 1, MaxCapacity: 10}),
+		"collector":        New().WithCollector(NewCollector("test", "lru", nil), "cache"),
+	}
+
+	for name, builder := range builders {
+		c := builder.WithCapacity(10).WithTTL(time.Minute).Build()
+		c.SetWithTags(key(0), value(0), "tag")
+		c.Destroy()
+
+		// nothing panics, reads miss, writes are dropped
+		c.Set(key(1), value(1))
+		c.SetPinned(key(2), value(2))
+		c.SetWithPriority(key(3), value(3), 1)
+		c.SetWithTags(key(4), value(4), "tag")
+		c.SetMany(map[string]interface{}{key(5): value(5)})
+		c.GetOrSet(key(6), value(6))
+		c.Compute(key(7), func(interface{}, bool) (interface{}, bool) { return value(7), true })
+		c.Resize(20)
+		c.Purge()
+		c.PurgeWithCallbacks()
+		c.InvalidateTag("tag")
+		c.DeleteByPrefix("key")
+		c.Touch(key(0))
+		c.Pin(key(0))
+
+		if _, found := c.Get(key(1)); found || c.Len() != 0 || len(c.Keys()) != 0 {
+			t.Errorf("%s: expected destroyed cache empty", name)
+		}
+
+		if _, err := c.GetOrLoad(key(8), func(string) (interface{}, error) { return value(8), nil }); err != ErrDestroyed {
+			t.Errorf("%s: expected ErrDestroyed, got %v", name, err)
+		}
+
+		c.Destroy()
+	}
+}
+
+func Test_LRU_destroy_concurrent(t *testing.T) {
+	builders := map[string]Builder{
+		"sync":             New().WithSync().WithTraceRecorder(io.Discard, 1),
+		"concurrent reads": New().WithSync().WithConcurrentReads().WithSecondChance().WithTraceRecorder(io.Discard, 1),
+	}
+
+	for name, builder := range builders {
+		c := builder.WithCapacity(10).Build()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					c.Set(key(i%20), value(g))
+					c.Get(key(i % 20))
+				}
+			}(g)
+		}
+
+		// must not race with the calls above, run with -race
+		c.Destroy()
+		wg.Wait()
+
+		if c.Len() != 0 {
+			t.Errorf("%s: expected destroyed cache empty", name)
+		}
+	}
+}
+
+func Test_LRU_metrics_registration_conflict(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	builder := New().WithCapacity(10).WithPriorities(2).WithMetrics("test", "lru", nil).WithMetricsRegisterer(registry)
+
+	c, err := builder.BuildE()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	count, _ := testutil.GatherAndCount(registry)
+
+	if _, err := builder.BuildE(); err == nil {
+		t.Fatal("expected registration conflict")
+	}
+
+	// metrics of the first cache are kept
+	if after, _ := testutil.GatherAndCount(registry); after != count {
+		t.Errorf("expected %d metrics after the conflict, got %d", count, after)
+	}
+
+	c.Destroy()
+
+	// failed build doesn't leave registered metrics behind
+	c, err = builder.BuildE()
+	if err != nil {
+		t.Fatalf("unexpected error after destroy: %s", err)
+	}
+	c.Destroy()
+}
+
+func Test_LRU_collector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	collector := NewCollector("test", "lru", nil)
+	registry.MustRegister(collector)
+
+	users := New().WithCapacity(2).WithSync().WithCollector(collector, "users").Build()
+	orders := New().WithCapacity(10).WithCollector(collector, "orders").Build()
+
+	for i := 0; i < 3; i++ {
+		users.Set(key(i), value(i))
+	}
+	users.Get(key(0))
+	users.Get(key(2))
+	users.Delete(key(2))
+	orders.GetMany([]string{key(0), key(1)})
+
+	expected := `
+# HELP test_lru_cache_evicted_total Total amount of keys evicted by cache overflow
+# TYPE test_lru_cache_evicted_total counter
+test_lru_cache_evicted_total{cache="orders"} 0
+test_lru_cache_evicted_total{cache="users"} 1
+# HELP test_lru_cache_hits_total Total amount of cache hits
+# TYPE test_lru_cache_hits_total counter
+test_lru_cache_hits_total{cache="orders"} 0
+test_lru_cache_hits_total{cache="users"} 1
+# HELP test_lru_cache_misses_total Total amount of cache misses
+# TYPE test_lru_cache_misses_total counter
+test_lru_cache_misses_total{cache="orders"} 2
+test_lru_cache_misses_total{cache="users"} 1
+# HELP test_lru_cache_sets_total Total amount of writes
+# TYPE test_lru_cache_sets_total counter
+test_lru_cache_sets_total{cache="orders"} 0
+test_lru_cache_sets_total{cache="users"} 3
+# HELP test_lru_cache_deletes_total Total amount of deleted keys
+# TYPE test_lru_cache_deletes_total counter
+test_lru_cache_deletes_total{cache="orders"} 0
+test_lru_cache_deletes_total{cache="users"} 1
+# HELP test_lru_cache_size Number of items in cache
+# TYPE test_lru_cache_size gauge
+test_lru_cache_size{cache="orders"} 0
+test_lru_cache_size{cache="users"} 1
+`
+	names := []string{
+		"test_lru_cache_evicted_total", "test_lru_cache_hits_total", "test_lru_cache_misses_total",
+		"test_lru_cache_sets_total", "test_lru_cache_deletes_total", "test_lru_cache_size",
+	}
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := New().WithCapacity(10).WithCollector(collector, "users").BuildE(); err == nil {
+		t.Error("expected duplicated cache name error")
+	}
+
+	// destroyed caches are not exported
+	users.Destroy()
+	orders.Destroy()
+
+	if count, _ := testutil.GatherAndCount(registry); count != 0 {
+		t.Errorf("expected no metrics after destroy, got %d", count)
+	}
+}
+
+func Test_LRU_hot_keys(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c := New().WithCapacity(10).WithSync().
+		WithMetrics("test", "lru", nil).
+		WithMetricsRegisterer(registry).
+		WithHotKeys(HotKeysConfig{Capacity: 3, SampleRate: 1, MetricKeys: 2}).
 		Build()
-	benchmarkLru(b, cache)
+
+	for i := 0; i < 5; i++ {
+		c.Get(key(0))
+	}
+	for i := 0; i < 3; i++ {
+		c.Set(key(1), value(1))
+	}
+	c.GetMany([]string{key(1), key(2)})
+
+	expected := []HotKey{{Key: key(0), Count: 5}, {Key: key(1), Count: 4}, {Key: key(2), Count: 1}}
+	if top := c.TopKeys(10); !reflect.DeepEqual(top, expected) {
+		t.Errorf("expected %v, got %v", expected, top)
+	}
+
+	metrics := fmt.Sprintf(`
+# HELP test_lru_cache_hot_key_requests Estimated total amount of requests of the most requested keys by rank
+# TYPE test_lru_cache_hot_key_requests gauge
+test_lru_cache_hot_key_requests{key_hash="%s",rank="1"} 5
+test_lru_cache_hot_key_requests{key_hash="%s",rank="2"} 4
+`, HotKeyHash(key(0)), HotKeyHash(key(1)))
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(metrics), "test_lru_cache_hot_key_requests"); err != nil {
+		t.Error(err)
+	}
+
+	c.Destroy()
+
+	if count, _ := testutil.GatherAndCount(registry); count != 0 {
+		t.Errorf("expected no metrics after destroy, got %d", count)
+	}
+
+	// hot keys are not tracked by default
+	if top := New().WithCapacity(10).Build().TopKeys(10); top != nil {
+		t.Errorf("expected no hot keys, got %v", top)
+	}
 }
 
-func BenchmarkSyncLRUNoExpiration(b *testing.B) {
-	cache := New().WithCapacity(10000).WithSync().WithTTL(time.Hour).Build()
-	benchmarkLru(b, cache)
+func Test_LRU_hot_keys_sampling(t *testing.T) {
+	c := New().WithCapacity(10).WithHotKeys(HotKeysConfig{SampleRate: 0.1}).Build()
+
+	for i := 0; i < 990; i++ {
+		c.Get(key(i % 3))
+	}
+
+	// every 10th call is counted, counts are scaled back
+	expected := []HotKey{{Key: key(0), Count: 330}, {Key: key(1), Count: 330}, {Key: key(2), Count: 330}}
+	if top := c.TopKeys(10); !reflect.DeepEqual(top, expected) {
+		t.Errorf("expected %v, got %v", expected, top)
+	}
+
+	if _, err := New().WithCapacity(10).WithHotKeys(HotKeysConfig{Capacity: 5, MetricKeys: 10}).BuildE(); err == nil {
+		t.Error("expected error for metric keys above capacity")
+	}
+}
+
+func Test_LRU_stats(t *testing.T) {
+	c := New().WithCapacity(2).WithSync().Build()
+
+	for i := 0; i < 3; i++ {
+		c.Set(key(i), value(i))
+	}
+	prev := c.Stats()
+
+	c.Get(key(0))
+	c.Get(key(2))
+	c.GetMany([]string{key(1), key(2)})
+	c.Delete(key(1))
+	c.Peek(key(2))
+	c.Exists(key(2))
+
+	// conditional writes don't count as hit or miss
+	c.CompareAndSwap(key(2), value(0), value(2))
+	c.CompareAndSwap(key(1), value(1), value(1))
+	c.CompareAndDelete(key(2), value(0))
+
+	loadErr := errors.New("load failed")
+	if _, err := c.GetOrLoad(key(3), func(string) (interface{}, error) { return nil, loadErr }); err != loadErr {
+		t.Errorf("expected load error, got %v", err)
+	}
+	if v, err := c.GetOrLoad(key(3), func(string) (interface{}, error) { return value(3), nil }); err != nil || v != value(3) {
+		t.Errorf("expected loaded value, got %v, %v", v, err)
+	}
+	if _, err := c.GetOrLoad(key(3), func(string) (interface{}, error) { return nil, loadErr }); err != nil {
+		t.Errorf("expected cached value, got error %v", err)
+	}
+
+	expected := Stats{
+		Hits:          4,
+		Misses:        3,
+		Sets:          4,
+		Deletes:       1,
+		Evictions:     1,
+		LoadSuccesses: 1,
+		LoadFailures:  1,
+		Size:          2,
+	}
+	if stats := c.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+
+	// delta keeps the current size
+	expected = Stats{Hits: 4, Misses: 3, Sets: 1, Deletes: 1, LoadSuccesses: 1, LoadFailures: 1, Size: 2}
+	if delta := StatsDelta(prev, c.Stats()); delta != expected {
+		t.Errorf("expected delta %+v, got %+v", expected, delta)
+	}
+
+	expvarJSON := StatsVar(c).String()
+	if !strings.Contains(expvarJSON, `"hits":4`) || !strings.Contains(expvarJSON, `"size":2`) {
+		t.Errorf("unexpected expvar value %s", expvarJSON)
+	}
+}
+
+type countingObserver struct{ count int }
+
+func (o *countingObserver) Observe(float64) { o.count++ }
+
+func Test_LRU_latency_sampling(t *testing.T) {
+	recorder := &latencyRecorder{every: 4}
+	for op := range latencyOpNames {
+		recorder.lockWait[op] = &countingObserver{}
+		recorder.operation[op] = &countingObserver{}
+	}
+
+	c := newWithSync(New().WithCapacity(10).Build(), recorder)
+	for i := 0; i < 100; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	if count := recorder.operation[latencyOpSet].(*countingObserver).count; count != 25 {
+		t.Errorf("expected 25 sampled sets, got %d", count)
+	}
+
+	if count := recorder.lockWait[latencyOpGet].(*countingObserver).count; count != 0 {
+		t.Errorf("expected no sampled gets, got %d", count)
+	}
+}
+
+func Test_LRU_latency_histograms(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c := New().WithCapacity(10).WithSync().WithMetrics("test", "lru", nil).WithMetricsRegisterer(registry).
+		WithLatencyHistograms([]float64{1e-6, 1e-3}, 1).Build()
+
+	c.Set(key(1), value(1))
+	c.Get(key(1))
+	c.Delete(key(1))
+
+	// lock wait and operation time for get, set and delete
+	if count, _ := testutil.GatherAndCount(registry, "test_lru_cache_lock_wait_seconds", "test_lru_cache_operation_seconds"); count != 6 {
+		t.Errorf("expected 6 histograms, got %d", count)
+	}
+
+	if _, err := New().WithCapacity(10).WithMetrics("test", "lru", nil).WithLatencyHistograms(nil, 0).BuildE(); err == nil {
+		t.Error("expected error without WithSync()")
+	}
+
+	c.Destroy()
+}
+
+func Test_LRU_trace_recorder(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := New().WithCapacity(10).
+		WithMetrics("test", "lru", nil).
+		WithMetricsRegisterer(prometheus.NewRegistry()).
+		WithTraceRecorder(&buf, 1).
+		Build()
+
+	c.Set(key(0), value(0))
+	c.Get(key(0))
+	c.Get(key(1))
+	c.Delete(key(0))
+	c.SetMany(map[string]interface{}{key(1): value(1)})
+	c.Set(key(1), value(1))
+	c.DeleteMany([]string{key(1), key(1), key(2)})
+
+	// recording doesn't add requests, bulk operations are counted once
+	requests := map[string]float64{"exists": 0, "set": 2, "set_many": 1, "delete": 1, "delete_many": 1}
+	for op, value := range requests {
+		if got := testutil.ToFloat64(c.(*lruWithTrace).parent.(*lruWithMetrics).requestsMetric.WithLabelValues(op)); got != value {
+			t.Errorf("expected %v %s requests, got %v", value, op, got)
+		}
+	}
+
+	c.Destroy()
+
+	expected := []trace.Record{
+		{Op: trace.OpSet, KeyHash: trace.HashKey(key(0)), Hit: false},
+		{Op: trace.OpGet, KeyHash: trace.HashKey(key(0)), Hit: true},
+		{Op: trace.OpGet, KeyHash: trace.HashKey(key(1)), Hit: false},
+		{Op: trace.OpDelete, KeyHash: trace.HashKey(key(0)), Hit: true},
+		{Op: trace.OpSet, KeyHash: trace.HashKey(key(1)), Hit: false},
+		{Op: trace.OpSet, KeyHash: trace.HashKey(key(1)), Hit: true},
+		{Op: trace.OpDelete, KeyHash: trace.HashKey(key(1)), Hit: true},
+		{Op: trace.OpDelete, KeyHash: trace.HashKey(key(1)), Hit: false},
+		{Op: trace.OpDelete, KeyHash: trace.HashKey(key(2)), Hit: false},
+	}
+
+	r := trace.NewReader(&buf)
+	for i := range expected {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("read record %d: %s", i, err)
+		}
+		if got.Op != expected[i].Op || got.KeyHash != expected[i].KeyHash || got.Hit != expected[i].Hit {
+			t.Errorf("expected %s %x %t, got %s %x %t",
+				expected[i].Op, expected[i].KeyHash, expected[i].Hit, got.Op, got.KeyHash, got.Hit)
+		}
+	}
+
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func Test_LRU_pinned(t *testing.T) {
+	capacity := 10
+
+	c := New().WithCapacity(capacity).WithMaxPinned(0.2).Build()
+
+	if !c.SetPinned(key(0), value(0)) {
+		t.Fatalf("expected key \"%s\" pinned", key(0))
+	}
+
+	c.Set(key(1), value(1))
+	if !c.Pin(key(1)) {
+		t.Fatalf("expected key \"%s\" pinned", key(1))
+	}
+
+	c.Set(key(2), value(2))
+	if c.Pin(key(2)) {
+		t.Errorf("expected pin limit reached")
+	}
+
+	for i := 3; i < capacity*3; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, found := c.Get(key(i)); !found {
+			t.Errorf("expected pinned key \"%s\" in cache", key(i))
+		}
+	}
+
+	if !c.Unpin(key(0)) {
+		t.Fatalf("expected key \"%s\" unpinned", key(0))
+	}
+
+	for i := capacity * 3; i < capacity*4; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	if _, found := c.Get(key(0)); found {
+		t.Errorf("expected unpinned key \"%s\" evicted", key(0))
+	}
+}
+
+func Test_LRU_pinned_expiration(t *testing.T) {
+	ttl := time.Millisecond * 10
+	clock := lrutest.NewFakeClock(time.Now())
+
+	c := New().WithCapacity(10).WithTTL(ttl).WithClock(clock).Build()
+	cExpire := New().WithCapacity(10).WithTTL(ttl).WithClock(clock).WithPinnedExpiration().Build()
+
+	c.SetPinned(key(0), value(0))
+	cExpire.SetPinned(key(0), value(0))
+
+	clock.Advance(ttl * 2)
+
+	if _, found := c.Get(key(0)); !found {
+		t.Errorf("expected pinned key \"%s\" not expired", key(0))
+	}
+
+	if _, found := cExpire.Get(key(0)); found {
+		t.Errorf("expected pinned key \"%s\" expired", key(0))
+	}
+}
+
+func Test_LRU_priorities(t *testing.T) {
+	capacity := 4
+
+	c := New().WithCapacity(capacity).WithPriorities(3).Build()
+
+	c.SetWithPriority(key(0), value(0), 2)
+	c.SetWithPriority(key(1), value(1), 1)
+	c.SetWithPriority(key(2), value(2), 0)
+	c.SetWithPriority(key(3), value(3), 1)
+
+	// victims are taken from the lowest non-empty class, oldest first
+	expectedEvicted := []string{key(2), key(1), key(3), key(0)}
+	for i := range expectedEvicted {
+		c.SetWithPriority(key(4+i), value(4+i), 2)
+
+		if c.Exists(expectedEvicted[i]) {
+			t.Errorf("expected key \"%s\" evicted", expectedEvicted[i])
+		}
+	}
+
+	for i := 4; i < 8; i++ {
+		if !c.Exists(key(i)) {
+			t.Errorf("expected key \"%s\" in cache", key(i))
+		}
+	}
+}
+
+func Test_LRU_priorities_overwrite(t *testing.T) {
+	capacity := 4
+
+	c := New().WithCapacity(capacity).WithPriorities(3).Build()
+
+	c.SetWithPriority(key(0), value(0), 2)
+
+	// refreshing the value doesn't demote the key
+	c.Set(key(0), value(1))
+	c.SetWithTags(key(0), value(2), "tag")
+
+	for i := 1; i < capacity*2; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	if !c.Exists(key(0)) {
+		t.Errorf("expected overwritten key \"%s\" kept in its priority class", key(0))
+	}
+
+	// explicit priority moves the key
+	c.SetWithPriority(key(0), value(0), 0)
+	for i := capacity * 2; i < capacity*3; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	if c.Exists(key(0)) {
+		t.Errorf("expected key \"%s\" evicted from the lowest class", key(0))
+	}
+}
+
+func Test_LRU_atomic_operations_keep_entry(t *testing.T) {
+	capacity := 10
+
+	c := New().WithCapacity(capacity).WithPriorities(2).WithMaxPinned(0.5).Build()
+
+	c.SetWithPriority(key(0), 1, 1)
+	c.SetPinned(key(1), 1)
+
+	c.Compute(key(0), func(old interface{}, exists bool) (interface{}, bool) { return old.(int) + 1, true })
+	c.CompareAndSwap(key(0), 2, 3)
+	c.Compute(key(1), func(old interface{}, exists bool) (interface{}, bool) { return old.(int) + 1, true })
+	c.CompareAndSwap(key(1), 2, 3)
+
+	// a scan of ordinary keys evicts neither the high priority key nor the pinned one
+	for i := 2; i < capacity*3; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	for i := 0; i < 2; i++ {
+		if val, found := c.Get(key(i)); !found || val != 3 {
+			t.Errorf("expected updated key \"%s\" kept, got %v, %t", key(i), val, found)
+		}
+	}
+
+	if !c.Unpin(key(1)) {
+		t.Errorf("expected key \"%s\" still pinned", key(1))
+	}
+}
+
+func Test_LRU_atomic_operations(t *testing.T) {
+	c := New().WithCapacity(10).WithSync().Build()
+
+	if actual, loaded := c.GetOrSet(key(0), 1); loaded || actual != 1 {
+		t.Errorf("expected value stored, got %v, %t", actual, loaded)
+	}
+
+	if actual, loaded := c.GetOrSet(key(0), 2); !loaded || actual != 1 {
+		t.Errorf("expected value loaded, got %v, %t", actual, loaded)
+	}
+
+	if c.CompareAndSwap(key(0), 2, 3) {
+		t.Errorf("expected swap to fail")
+	}
+
+	if !c.CompareAndSwap(key(0), 1, 3) {
+		t.Errorf("expected swap to succeed")
+	}
+
+	if c.CompareAndDelete(key(0), 1) {
+		t.Errorf("expected delete to fail")
+	}
+
+	if !c.CompareAndDelete(key(0), 3) || c.Exists(key(0)) {
+		t.Errorf("expected key deleted")
+	}
+
+	// uncomparable values are never equal
+	slice := []int{1}
+	c.Set(key(0), slice)
+	if c.CompareAndSwap(key(0), slice, 1) || c.CompareAndDelete(key(0), slice) {
+		t.Errorf("expected uncomparable values not equal")
+	}
+	m := map[string]int{}
+	c.Set(key(0), m)
+	if c.CompareAndSwap(key(0), m, 1) {
+		t.Errorf("expected swap of map to fail")
+	}
+	c.Delete(key(0))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				c.Compute(key(1), func(old interface{}, exists bool) (interface{}, bool) {
+					if !exists {
+						return 1, true
+					}
+					return old.(int) + 1, true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if val, _ := c.Get(key(1)); val != 1000 {
+		t.Errorf("expected counter 1000, got %v", val)
+	}
+
+	if _, kept := c.Compute(key(1), func(interface{}, bool) (interface{}, bool) { return nil, false }); kept || c.Exists(key(1)) {
+		t.Errorf("expected key deleted by compute")
+	}
+}
+
+func Test_LRU_get_or_load_unlocked(t *testing.T) {
+	builders := map[string]Builder{
+		"sync":             New().WithSync(),
+		"concurrent reads": New().WithSync().WithConcurrentReads().WithSecondChance(),
+		"trace":            New().WithSync().WithTraceRecorder(io.Discard, 1),
+	}
+
+	for name, builder := range builders {
+		c := builder.WithCapacity(10).Build()
+
+		// load runs without the lock, so it may access the cache
+		v, err := c.GetOrLoad(key(0), func(string) (interface{}, error) {
+			c.Set(key(1), value(1))
+			val, _ := c.Get(key(1))
+			return val, nil
+		})
+		if err != nil || v != value(1) {
+			t.Errorf("%s: expected loaded value, got %v, %v", name, v, err)
+		}
+
+		if val, found := c.Get(key(0)); !found || val != value(1) {
+			t.Errorf("%s: expected loaded value stored, got %v, %t", name, val, found)
+		}
+
+		// a panicking loader leaves the cache usable
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected loader panic", name)
+				}
+			}()
+			_, _ = c.GetOrLoad(key(2), func(string) (interface{}, error) { panic("load failed") })
+		}()
+
+		c.Set(key(2), value(2))
+		if val, found := c.Get(key(2)); !found || val != value(2) {
+			t.Errorf("%s: expected cache usable after loader panic, got %v, %t", name, val, found)
+		}
+
+		c.Destroy()
+	}
+}
+
+func Test_LRU_bulk_operations(t *testing.T) {
+	var deleted []string
+
+	c := New().WithCapacity(10).WithSync().
+		WithDeleteCallback(func(key string) { deleted = append(deleted, key) }).
+		Build()
+
+	c.SetMany(map[string]interface{}{key(0): value(0), key(1): value(1), key(2): value(2)})
+
+	values, found := c.GetMany([]string{key(0), key(1), key(3)})
+	if !found[0] || !found[1] || found[2] || values[0] != value(0) || values[1] != value(1) {
+		t.Errorf("unexpected GetMany result %v, %v", values, found)
+	}
+
+	if n := c.DeleteMany([]string{key(0), key(2), key(3)}); n != 2 {
+		t.Errorf("expected 2 keys deleted, got %d", n)
+	}
+
+	if len(deleted) != 2 {
+		t.Errorf("expected delete callback called for each deleted key, got %v", deleted)
+	}
+}
+
+func Test_LRU_range(t *testing.T) {
+	capacity := 5
+
+	c := New().WithCapacity(capacity).WithSync().Build()
+
+	for i := 0; i < capacity+2; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	if c.Len() != capacity {
+		t.Errorf("expected len %d, got %d", capacity, c.Len())
+	}
+
+	if keys := fmt.Sprint(c.Keys()); keys != "[key-2 key-3 key-4 key-5 key-6]" {
+		t.Errorf("unexpected keys %s", keys)
+	}
+
+	var reversed []string
+	c.RangeReverse(func(key string, value interface{}, _ time.Time) bool {
+		reversed = append(reversed, key)
+		return len(reversed) < 2
+	})
+
+	if fmt.Sprint(reversed) != "[key-6 key-5]" {
+		t.Errorf("unexpected reverse walk %v", reversed)
+	}
+}
+
+func Test_LRU_range_expired(t *testing.T) {
+	ttl := time.Millisecond * 20
+	clock := lrutest.NewFakeClock(time.Now())
+
+	c := New().WithCapacity(10).WithTTL(ttl).WithClock(clock).Build()
+
+	c.Set(key(0), value(0))
+	clock.Advance(ttl * 2)
+	c.Set(key(1), value(1))
+
+	c.Range(func(key string, value interface{}, expireAt time.Time) bool {
+		if key != "key-1" {
+			t.Errorf("unexpected key %s", key)
+		}
+		if expireAt.Before(time.Now()) {
+			t.Errorf("unexpected expiration time %s", expireAt)
+		}
+		return true
+	})
+}
+
+func Test_LRU_peek(t *testing.T) {
+	ttl := time.Millisecond * 20
+	clock := lrutest.NewFakeClock(time.Now())
+
+	var expired []string
+
+	c := New().WithCapacity(2).WithTTL(ttl).WithClock(clock).WithSegmentedLRU(0.5).
+		WithExpireCallback(func(key string) { expired = append(expired, key) }).
+		Build()
+
+	c.Set(key(0), value(0))
+	c.Set(key(1), value(1))
+
+	// peek doesn't promote key(0), so it is still the next victim
+	if val, found := c.Peek(key(0)); !found || val != value(0) {
+		t.Errorf("expected key \"%s\" peeked", key(0))
+	}
+	c.Set(key(2), value(2))
+	if c.Exists(key(0)) {
+		t.Errorf("expected key \"%s\" evicted", key(0))
+	}
+
+	clock.Advance(ttl * 2)
+
+	if _, found := c.Peek(key(1)); found {
+		t.Errorf("expected key \"%s\" expired", key(1))
+	}
+	if !c.Exists(key(1)) || len(expired) != 0 {
+		t.Errorf("expected peek not to remove expired key")
+	}
+}
+
+func Test_LRU_touch(t *testing.T) {
+	ttl := time.Millisecond * 50
+
+	c := New().WithCapacity(2).WithTTL(ttl).Build()
+
+	c.Set(key(0), value(0))
+	c.Set(key(1), value(1))
+
+	if !c.TouchWithTTL(key(0), time.Hour) {
+		t.Fatalf("expected key \"%s\" touched", key(0))
+	}
+
+	if ttl, found := c.TTL(key(0)); !found || ttl < time.Minute {
+		t.Errorf("expected refreshed TTL, got %s", ttl)
+	}
+
+	// key(0) became the newest one
+	c.Set(key(2), value(2))
+	if !c.Exists(key(0)) || c.Exists(key(1)) {
+		t.Errorf("expected key \"%s\" evicted instead of touched key", key(1))
+	}
+
+	if c.Touch(key(3)) {
+		t.Errorf("expected touch of missing key to fail")
+	}
+}
+
+func Test_LRU_purge(t *testing.T) {
+	var deleted []string
+
+	c := New().WithCapacity(5).WithPriorities(2).WithMaxPinned(0.2).
+		WithMetrics("test", "lru", nil).
+		WithMetricsRegisterer(prometheus.NewRegistry()).
+		WithDeleteCallback(func(key string) { deleted = append(deleted, key) }).
+		Build()
+
+	for i := 0; i < 5; i++ {
+		c.Set(key(i), value(i))
+	}
+	if !c.Pin(key(0)) {
+		t.Fatalf("expected key \"%s\" pinned", key(0))
+	}
+
+	c.Purge()
+
+	if c.Len() != 0 || len(c.Keys()) != 0 || len(deleted) != 0 {
+		t.Errorf("expected empty cache without hooks called")
+	}
+
+	// pinned keys are unpinned through the unpin hook
+	if pinned := testutil.ToFloat64(c.(*lruWithMetrics).pinnedMetric); pinned != 0 {
+		t.Errorf("expected no pinned keys after purge, got %v", pinned)
+	}
+
+	// the cache is still usable after purge
+	for i := 0; i < 10; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	c.PurgeWithCallbacks()
+
+	if c.Len() != 0 || len(deleted) != 5 {
+		t.Errorf("expected empty cache with delete hook called for each key, got %v", deleted)
+	}
+}
+
+func Test_LRU_delete_by_prefix(t *testing.T) {
+	for _, c := range []Cache{
+		New().WithCapacity(10).Build(),
+		New().WithCapacity(10).WithPrefixIndex().Build(),
+	} {
+		c.Set("tenant1:a", 1)
+		c.Set("tenant1:b", 2)
+		c.Set("tenant10:a", 3)
+		c.Set("tenant2:a", 4)
+
+		if n := c.DeleteByPrefix("tenant1:"); n != 2 {
+			t.Errorf("expected 2 keys deleted, got %d", n)
+		}
+
+		if n := c.DeleteFunc(func(key string, value interface{}) bool { return value.(int) > 3 }); n != 1 {
+			t.Errorf("expected 1 key deleted, got %d", n)
+		}
+
+		if keys := fmt.Sprint(c.Keys()); keys != "[tenant10:a]" {
+			t.Errorf("unexpected keys %s", keys)
+		}
+
+		c.Purge()
+		c.Set("tenant1:c", 5)
+
+		if n := c.DeleteByPrefix("tenant"); n != 1 {
+			t.Errorf("expected 1 key deleted after purge, got %d", n)
+		}
+	}
+}
+
+func Test_LRU_tags(t *testing.T) {
+	capacity := 3
+
+	c := New().WithCapacity(capacity).Build()
+	b := c.(*base)
+
+	c.SetWithTags(key(0), value(0), "row:1", "row:2")
+	c.SetWithTags(key(1), value(1), "row:2")
+	c.SetWithTags(key(2), value(2), "row:3")
+
+	if n := c.InvalidateTag("row:2"); n != 2 {
+		t.Errorf("expected 2 keys invalidated, got %d", n)
+	}
+
+	if keys := fmt.Sprint(c.Keys()); keys != "[key-2]" {
+		t.Errorf("unexpected keys %s", keys)
+	}
+
+	// overwrite detaches old tags
+	c.Set(key(2), value(2))
+	if n := c.InvalidateTag("row:3"); n != 0 {
+		t.Errorf("expected no keys invalidated, got %d", n)
+	}
+
+	// evicted keys are removed from the index
+	for i := 0; i < capacity*2; i++ {
+		c.SetWithTags(key(i), value(i), "row:4")
+	}
+
+	if b.tags.TagsLen() != 1 || b.tags.EntriesLen() != capacity {
+		t.Errorf("unexpected tag index size %d/%d", b.tags.TagsLen(), b.tags.EntriesLen())
+	}
+
+	c.Purge()
+
+	if b.tags.TagsLen() != 0 || b.tags.EntriesLen() != 0 {
+		t.Errorf("expected empty tag index after purge")
+	}
+}
+
+func Test_LRU_tags_atomic_update(t *testing.T) {
+	c := New().WithCapacity(10).Build()
+
+	c.SetWithTags(key(0), 1, "row:1")
+	c.SetWithTags(key(1), 1, "row:1")
+
+	c.CompareAndSwap(key(0), 1, 2)
+	c.Compute(key(1), func(old interface{}, exists bool) (interface{}, bool) { return 2, true })
+
+	if deleted := c.InvalidateTag("row:1"); deleted != 2 {
+		t.Errorf("expected updated keys invalidated by tag, %d deleted", deleted)
+	}
+}
+
+func Test_LRU_tags_atomic_update_expired(t *testing.T) {
+	clock := lrutest.NewFakeClock(time.Now())
+	c := New().WithCapacity(10).WithTTL(time.Minute).WithClock(clock).WithSync().WithConcurrentReads().Build()
+
+	c.SetWithTags(key(0), 1, "row:1")
+	c.SetWithTags(key(1), 1, "row:1")
+
+	// lazy expiration keeps expired keys in the cache until they are overwritten
+	clock.Advance(2 * time.Minute)
+
+	c.GetOrSet(key(0), 2)
+	c.Compute(key(1), func(old interface{}, exists bool) (interface{}, bool) { return 2, true })
+
+	if deleted := c.InvalidateTag("row:1"); deleted != 0 {
+		t.Errorf("expected values stored after expiration untagged, %d deleted", deleted)
+	}
+
+	if c.Len() != 2 {
+		t.Errorf("expected 2 keys, got %d", c.Len())
+	}
+}
+
+func Test_LRU_resize(t *testing.T) {
+	builders := map[string]Builder{
+		"lru":           New(),
+		"segmented":     New().WithSegmentedLRU(0.5),
+		"second chance": New().WithSecondChance(),
+	}
+
+	for name, builder := range builders {
+		var evicted []string
+
+		c := builder.WithCapacity(10).
+			WithEvictCallback(func(key string) { evicted = append(evicted, key) }).
+			Build()
+
+		for i := 0; i < 10; i++ {
+			c.Set(key(i), value(i))
+			c.Get(key(i))
+		}
+
+		c.Resize(4)
+
+		if c.Capacity() != 4 || c.Len() != 4 || len(evicted) != 6 {
+			t.Errorf("%s: expected 4 keys left and 6 evicted, got %d and %d", name, c.Len(), len(evicted))
+		}
+
+		c.Resize(20)
+
+		for i := 10; i < 26; i++ {
+			c.Set(key(i), value(i))
+		}
+
+		if c.Len() != 20 || len(evicted) != 6 {
+			t.Errorf("%s: expected 20 keys without evictions after grow, got %d and %d", name, c.Len(), len(evicted))
+		}
+
+		c.Set(key(26), value(26))
+
+		if c.Len() != 20 || len(evicted) != 7 {
+			t.Errorf("%s: expected eviction at the new capacity", name)
+		}
+
+		// capacity less than one is ignored
+		c.Resize(0)
+		c.Resize(-1)
+
+		if c.Capacity() != 20 || c.Len() != 20 || len(evicted) != 7 {
+			t.Errorf("%s: expected resize to non-positive capacity ignored", name)
+		}
+	}
+}
+
+func Test_LRU_memory_controller(t *testing.T) {
+	c := New().WithCapacity(100).WithSync().WithMemoryController(MemoryControllerConfig{
+		MinCapacity:   50,
+		MaxCapacity:   120,
+		Interval:      time.Hour,
+		HighWatermark: 0.9,
+		LowWatermark:  0.5,
+		Step:          0.2,
+	}).Build()
+	defer c.Destroy()
+
+	controller := c.(*lruWithMemoryController)
+
+	var live, limit, gcCycles uint64 = 95, 100, 0
+	controller.readMemory = func() (uint64, uint64, uint64) {
+		gcCycles++
+		return live, limit, gcCycles
+	}
+
+	expected := []int{80, 64, 51, 50, 50}
+	for i := range expected {
+		controller.adjust()
+		if c.Capacity() != expected[i] {
+			t.Errorf("expected capacity %d after shrink, got %d", expected[i], c.Capacity())
+		}
+	}
+
+	// between watermarks nothing changes
+	live = 70
+	controller.adjust()
+	if c.Capacity() != 50 {
+		t.Errorf("expected capacity unchanged, got %d", c.Capacity())
+	}
+
+	live = 10
+	expected = []int{60, 72, 87, 105, 120, 120}
+	for i := range expected {
+		controller.adjust()
+		if c.Capacity() != expected[i] {
+			t.Errorf("expected capacity %d after grow, got %d", expected[i], c.Capacity())
+		}
+	}
+
+	// no memory limit - no control
+	limit = math.MaxInt64
+	live = 1 << 62
+	controller.adjust()
+	if c.Capacity() != 120 {
+		t.Errorf("expected capacity unchanged without memory limit, got %d", c.Capacity())
+	}
+
+	// live heap is only updated by GC, so the same reading is not acted on twice
+	limit = 100
+	controller.readMemory = func() (uint64, uint64, uint64) { return live, limit, 100 }
+	controller.adjust()
+	controller.adjust()
+	controller.adjust()
+	if c.Capacity() != 96 {
+		t.Errorf("expected one shrink per GC cycle, got capacity %d", c.Capacity())
+	}
+
+	// the initial capacity is clamped to the controller range
+	c = New().WithCapacity(200).WithSync().WithMemoryController(MemoryControllerConfig{MinCapacity: 50, MaxCapacity: 120}).Build()
+	if c.Capacity() != 120 {
+		t.Errorf("expected capacity clamped to 120, got %d", c.Capacity())
+	}
+	c.Destroy()
+}
+
+func Test_LRU_memory_controller_metrics(t *testing.T) {
+	c := New().WithCapacity(100).WithSync().WithMetrics("memory_controller", "lru", nil).
+		WithMemoryController(MemoryControllerConfig{MinCapacity: 50, MaxCapacity: 120, Interval: time.Hour}).
+		Build()
+	defer c.Destroy()
+
+	// make a resize, so the resizes counter has a series
+	controller := c.(*lruWithMemoryController)
+	controller.readMemory = func() (uint64, uint64, uint64) { return 95, 100, 1 }
+	controller.adjust()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	names := make(map[string]bool)
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+
+	for _, name := range []string{"memory_controller_lru_cache_target_capacity", "memory_controller_lru_cache_resizes_total"} {
+		if !names[name] {
+			t.Errorf("expected metric %s registered", name)
+		}
+	}
+}
+
+func Test_LRU_memory_controller_clock(t *testing.T) {
+	clock := lrutest.NewFakeClock(time.Now())
+
+	c := New().WithCapacity(100).WithSync().WithClock(clock).WithMemoryController(MemoryControllerConfig{
+		MinCapacity: 50,
+		MaxCapacity: 120,
+		Interval:    time.Second,
+		Step:        0.2,
+	}).Build()
+	defer c.Destroy()
+
+	var gcCycles uint64
+	c.(*lruWithMemoryController).readMemory = func() (uint64, uint64, uint64) {
+		gcCycles++
+		return 95, 100, gcCycles
+	}
+
+	clock.Advance(time.Millisecond * 2500)
+	if c.Capacity() != 64 {
+		t.Errorf("expected capacity 64 after two checks, got %d", c.Capacity())
+	}
+
+	clock.Advance(time.Second)
+	if c.Capacity() != 51 {
+		t.Errorf("expected capacity 51 after three checks, got %d", c.Capacity())
+	}
+}
+
+func Test_LRU_discrete_clock_shared(t *testing.T) {
+	interval := time.Millisecond * 5
+
+	c1 := New().WithCapacity(10).WithTTL(time.Hour).WithDiscreteClock(interval).Build()
+	c2 := New().WithCapacity(10).WithTTL(time.Hour).WithDiscreteClock(interval).Build()
+
+	shared := c1.(*base).clock.(*ClockDiscrete).shared
+	if c2.(*base).clock.(*ClockDiscrete).shared != shared {
+		t.Fatal("expected caches with the same update interval to share the clock")
+	}
+
+	before := atomic.LoadInt64(&shared.nanos)
+	time.Sleep(interval * 4)
+	if atomic.LoadInt64(&shared.nanos) <= before {
+		t.Error("expected the shared clock refreshed")
+	}
+
+	c1.Destroy()
+	// destroying twice must not release the clock twice
+	c1.(*base).clock.Stop()
+
+	coarseClocksMu.Lock()
+	_, found := coarseClocks[interval]
+	coarseClocksMu.Unlock()
+	if !found {
+		t.Error("expected the shared clock alive while used by a cache")
+	}
+
+	c2.Destroy()
+
+	coarseClocksMu.Lock()
+	_, found = coarseClocks[interval]
+	coarseClocksMu.Unlock()
+	if found {
+		t.Error("expected the shared clock stopped with the last cache")
+	}
+}
+
+const accessKeysSize = 1000000
+
+func BenchmarkMapNoExpiration(b *testing.B) {
+	cache := make(map[string]int)
+	var keys []string
+	var accessKeys = make([]string, accessKeysSize)
+	for i := 0; i < 10000; i++ {
+		k := randomWord(10)
+		keys = append(keys, k)
+		cache[k] = rand.Intn(1024)
+	}
+
+	for i := 0; i < accessKeysSize; i++ {
+		accessKeys[i] = keys[rand.Intn(len(keys))]
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = cache[accessKeys[i%accessKeysSize]]
+	}
+}
+
+func benchmarkLru(b *testing.B, cache Cache) {
+	var keys []string
+	var accessKeys = make([]string, accessKeysSize)
+	for i := 0; i < 10000; i++ {
+		k := randomWord(10)
+		keys = append(keys, k)
+		cache.Set(k, rand.Intn(1024))
+	}
+
+	for i := 0; i < accessKeysSize; i++ {
+		accessKeys[i] = keys[rand.Intn(len(keys))]
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(accessKeys[i%accessKeysSize])
+	}
+}
+
+func BenchmarkLRUNoExpiration(b *testing.B) {
+	cache := New().
+		WithCapacity(10000).
+		WithTTL(time.Hour).
+		Build()
+	benchmarkLru(b, cache)
+}
+
+func BenchmarkSyncLRUNoExpiration(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithTTL(time.Hour).Build()
+	benchmarkLru(b, cache)
+}
+
+func benchmarkLruParallel(b *testing.B, cache Cache) {
+	var keys []string
+	var accessKeys = make([]string, accessKeysSize)
+	for i := 0; i < 10000; i++ {
+		k := randomWord(10)
+		keys = append(keys, k)
+		cache.Set(k, rand.Intn(1024))
+	}
+
+	for i := 0; i < accessKeysSize; i++ {
+		accessKeys[i] = keys[rand.Intn(len(keys))]
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(accessKeysSize)
+		for pb.Next() {
+			cache.Get(accessKeys[i%accessKeysSize])
+			i++
+		}
+	})
+}
+
+func BenchmarkSyncLRUParallel(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithTTL(time.Hour).Build()
+	benchmarkLruParallel(b, cache)
+}
+
+func BenchmarkConcurrentReadsLRUParallel(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithConcurrentReads().WithTTL(time.Hour).Build()
+	benchmarkLruParallel(b, cache)
+}
+
+func BenchmarkSyncSegmentedParallel(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithSegmentedLRU(0.8).WithTTL(time.Hour).Build()
+	benchmarkLruParallel(b, cache)
+}
+
+func BenchmarkConcurrentReadsSegmentedParallel(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithConcurrentReads().WithSegmentedLRU(0.8).WithTTL(time.Hour).Build()
+	benchmarkLruParallel(b, cache)
+}
+
+func BenchmarkSyncLRULatencyParallel(b *testing.B) {
+	// zero sample rate is a baseline with metrics but without histograms
+	for _, sampleRate := range []float64{0, 0.01, 1} {
+		b.Run(fmt.Sprintf("sample-%v", sampleRate), func(b *testing.B) {
+			builder := New().WithCapacity(10000).WithSync().WithTTL(time.Hour).
+				WithMetrics("bench", "lru", nil).WithMetricsRegisterer(prometheus.NewRegistry())
+			if sampleRate > 0 {
+				builder = builder.WithLatencyHistograms(nil, sampleRate)
+			}
+
+			cache := builder.Build()
+			defer cache.Destroy()
+
+			benchmarkLruParallel(b, cache)
+		})
+	}
+}
+
+func BenchmarkSyncSecondChanceNoExpiration(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithSecondChance().WithTTL(time.Hour).Build()
+	benchmarkLru(b, cache)
+}
+
+func BenchmarkSyncSecondChanceParallel(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithSecondChance().WithTTL(time.Hour).Build()
+	benchmarkLruParallel(b, cache)
+}
+
+func BenchmarkLRUDiscreteClock(b *testing.B) {
+	cache := New().WithCapacity(10000).WithTTL(time.Hour).WithDiscreteClock(0).Build()
+	benchmarkLru(b, cache)
+}
+
+func BenchmarkSyncLRUDiscreteClockParallel(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithTTL(time.Hour).WithDiscreteClock(0).Build()
+	benchmarkLruParallel(b, cache)
+}
+
+func benchmarkClockParallel(b *testing.B, clock clock) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			clock.nanotime()
+		}
+	})
+}
+
+func BenchmarkClockPreciseParallel(b *testing.B) {
+	benchmarkClockParallel(b, newClockPrecise())
+}
+
+func BenchmarkClockDiscreteParallel(b *testing.B) {
+	clock := newClockDiscrete(0)
+	defer clock.Stop()
+
+	benchmarkClockParallel(b, clock)
+}
+
+func Test_LRU_segmented_scan(t *testing.T) {
+	capacity := 10
+
+	c := New().WithCapacity(capacity).WithSegmentedLRU(0.5).Build()
+
+	// make hot keys protected
+	for i := 0; i < 5; i++ {
+		c.Set(key(i), value(i))
+		c.Get(key(i))
+	}
+
+	// scan through a lot of keys that are never read again
+	for i := 100; i < 200; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, found := c.Get(key(i)); !found {
+			t.Errorf("expected protected key \"%s\" to survive the scan", key(i))
+		}
+	}
+}
+
+func Test_LRU_segmented_demotion(t *testing.T) {
+	p := newPolicySegmented(4, 0.5)
+
+	for i := 0; i < 4; i++ {
+		p.Push(key(i))
+	}
+
+	// promote three keys into two-slot protected segment, key(0) is demoted
+	p.Access(key(0))
+	p.Access(key(1))
+	p.Access(key(2))
+
+	if p.ProtectedLen() != 2 || p.ProbationLen() != 2 {
+		t.Fatalf("expected 2/2 segments, got %d/%d", p.ProbationLen(), p.ProtectedLen())
+	}
+
+	// probation order: key(3), key(0)
+	expected := []string{key(3), key(0), key(1), key(2)}
+	for i := range expected {
+		victim, found := p.Shift()
+		if !found || victim != expected[i] {
+			t.Errorf("expected victim \"%s\", got \"%s\"", expected[i], victim)
+		}
+	}
+}
+
+func Test_LRU_second_chance(t *testing.T) {
+	capacity := 5
+
+	c := New().WithCapacity(capacity).WithSecondChance().Build()
+
+	for i := 0; i < capacity; i++ {
+		c.Set(key(i), value(i))
+	}
+
+	// key(0) gets the second chance, key(1) is evicted instead
+	c.Get(key(0))
+	c.Set(key(capacity), value(capacity))
+
+	if _, found := c.Get(key(0)); !found {
+		t.Errorf("expected referenced key \"%s\" in cache", key(0))
+	}
+
+	if _, found := c.Get(key(1)); found {
+		t.Errorf("expected key \"%s\" evicted", key(1))
+	}
+}
+
+func Test_LRU_second_chance_lazy_expiration(t *testing.T) {
+	capacity := 2
+	ttl := time.Millisecond * 10
+	clock := lrutest.NewFakeClock(time.Now())
+
+	var evicted, expired []string
+
+	c := New().WithCapacity(capacity).WithTTL(ttl).WithClock(clock).WithSecondChance().
+		WithEvictCallback(func(key string) { evicted = append(evicted, key) }).
+		WithExpireCallback(func(key string) { expired = append(expired, key) }).
+		Build()
+
+	c.Set(key(0), value(0))
+	c.Set(key(1), value(1))
+
+	clock.Advance(ttl * 2)
+
+	if _, found := c.Get(key(0)); found {
+		t.Errorf("expected key \"%s\" expired", key(0))
+	}
+
+	if len(expired) != 0 {
+		t.Errorf("expected no expiration on read, got %v", expired)
+	}
+
+	c.Set(key(2), value(2))
+
+	if len(expired) != 1 || expired[0] != key(0) || len(evicted) != 0 {
+		t.Errorf("expected \"%s\" expired on eviction, got expired %v, evicted %v", key(0), expired, evicted)
+	}
+}
+
+const batchSize = 200
+
+func benchmarkBatchKeys(cache Cache) [][]string {
+	var keys []string
+	for i := 0; i < 10000; i++ {
+		k := randomWord(10)
+		keys = append(keys, k)
+		cache.Set(k, rand.Intn(1024))
+	}
+
+	batches := make([][]string, 1000)
+	for i := range batches {
+		batches[i] = make([]string, batchSize)
+		for j := range batches[i] {
+			batches[i][j] = keys[rand.Intn(len(keys))]
+		}
+	}
+
+	return batches
+}
+
+func BenchmarkSyncLRUGetLoop(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithTTL(time.Hour).Build()
+	batches := benchmarkBatchKeys(cache)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, k := range batches[i%len(batches)] {
+			cache.Get(k)
+		}
+	}
+}
+
+func BenchmarkSyncLRUGetMany(b *testing.B) {
+	cache := New().WithCapacity(10000).WithSync().WithTTL(time.Hour).Build()
+	batches := benchmarkBatchKeys(cache)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.GetMany(batches[i%len(batches)])
+	}
 }
@@ -0,0 +1,337 @@
+package lru
+
+import (
+	"io"
+	"math"
+	"time"
+
+	"github.com/pavel-krush/cache/v2/lru/trace"
+)
+
+// traceBufferSize is the number of records buffered before the recorder starts dropping them
+const traceBufferSize = 4096
+
+// lruWithTrace is a wrapper for cache that records Get, Set and Delete operations.
+// Keys are sampled by hash, so all operations on the same key are either recorded or not.
+type lruWithTrace struct {
+	parent Cache
+	// base tells whether a write replaces a key without counting the check as a request of the parent
+	base *base
+
+	writer    *trace.Writer
+	threshold uint64
+	// destroyed is set when the writer is closed, nothing is recorded after
+	destroyed bool
+}
+
+func newWithTrace(parent Cache, baseCache *base, w io.Writer, sampleRate float64) *lruWithTrace {
+	threshold := uint64(math.MaxUint64)
+	if sampleRate < 1 {
+		threshold = uint64(sampleRate * math.MaxUint64)
+	}
+
+	return &lruWithTrace{
+		parent:    parent,
+		base:      baseCache,
+		writer:    trace.NewWriter(w, traceBufferSize),
+		threshold: threshold,
+	}
+}
+
+func (c *lruWithTrace) Capacity() int {
+	return c.parent.Capacity()
+}
+
+func (c *lruWithTrace) Resize(capacity int) {
+	c.parent.Resize(capacity)
+}
+
+func (c *lruWithTrace) Len() int {
+	return c.parent.Len()
+}
+
+func (c *lruWithTrace) Keys() []string {
+	return c.parent.Keys()
+}
+
+func (c *lruWithTrace) Range(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.parent.Range(fn)
+}
+
+func (c *lruWithTrace) RangeReverse(fn func(key string, value interface{}, expireAt time.Time) bool) {
+	c.parent.RangeReverse(fn)
+}
+
+func (c *lruWithTrace) Exists(key string) bool {
+	return c.parent.Exists(key)
+}
+
+func (c *lruWithTrace) Set(key string, value interface{}) {
+	hash, sampled := c.sample(key)
+	if !sampled {
+		c.parent.Set(key, value)
+		return
+	}
+
+	replaced := c.base.Exists(key)
+	c.parent.Set(key, value)
+	c.record(trace.OpSet, hash, replaced)
+}
+
+func (c *lruWithTrace) SetPinned(key string, value interface{}) bool {
+	hash, sampled := c.sample(key)
+	if !sampled {
+		return c.parent.SetPinned(key, value)
+	}
+
+	replaced := c.base.Exists(key)
+	ret := c.parent.SetPinned(key, value)
+	c.record(trace.OpSet, hash, replaced)
+
+	return ret
+}
+
+func (c *lruWithTrace) SetWithPriority(key string, value interface{}, priority int) {
+	hash, sampled := c.sample(key)
+	if !sampled {
+		c.parent.SetWithPriority(key, value, priority)
+		return
+	}
+
+	replaced := c.base.Exists(key)
+	c.parent.SetWithPriority(key, value, priority)
+	c.record(trace.OpSet, hash, replaced)
+}
+
+func (c *lruWithTrace) SetWithTags(key string, value interface{}, tags ...string) {
+	hash, sampled := c.sample(key)
+	if !sampled {
+		c.parent.SetWithTags(key, value, tags...)
+		return
+	}
+
+	replaced := c.base.Exists(key)
+	c.parent.SetWithTags(key, value, tags...)
+	c.record(trace.OpSet, hash, replaced)
+}
+
+func (c *lruWithTrace) InvalidateTag(tag string) int {
+	return c.parent.InvalidateTag(tag)
+}
+
+func (c *lruWithTrace) Pin(key string) bool {
+	return c.parent.Pin(key)
+}
+
+func (c *lruWithTrace) Unpin(key string) bool {
+	return c.parent.Unpin(key)
+}
+
+func (c *lruWithTrace) Delete(key string) bool {
+	deleted := c.parent.Delete(key)
+	if hash, sampled := c.sample(key); sampled {
+		c.record(trace.OpDelete, hash, deleted)
+	}
+
+	return deleted
+}
+
+func (c *lruWithTrace) Get(key string) (interface{}, bool) {
+	ret, found := c.parent.Get(key)
+	if hash, sampled := c.sample(key); sampled {
+		c.record(trace.OpGet, hash, found)
+	}
+
+	return ret, found
+}
+
+// Peek is not recorded
+func (c *lruWithTrace) Peek(key string) (interface{}, bool) {
+	return c.parent.Peek(key)
+}
+
+func (c *lruWithTrace) Touch(key string) bool {
+	return c.parent.Touch(key)
+}
+
+func (c *lruWithTrace) TouchWithTTL(key string, ttl time.Duration) bool {
+	return c.parent.TouchWithTTL(key, ttl)
+}
+
+func (c *lruWithTrace) GetOrSet(key string, value interface{}) (interface{}, bool) {
+	ret, loaded := c.parent.GetOrSet(key, value)
+	if hash, sampled := c.sample(key); sampled {
+		c.record(trace.OpGet, hash, loaded)
+		if !loaded {
+			c.record(trace.OpSet, hash, false)
+		}
+	}
+
+	return ret, loaded
+}
+
+func (c *lruWithTrace) GetOrLoad(key string, load func(key string) (interface{}, error)) (interface{}, error) {
+	var loaded, failed bool
+
+	ret, err := c.parent.GetOrLoad(key, func(key string) (interface{}, error) {
+		loaded = true
+		value, err := load(key)
+		failed = err != nil
+		return value, err
+	})
+
+	if hash, sampled := c.sample(key); sampled {
+		c.record(trace.OpGet, hash, !loaded)
+		if loaded && !failed {
+			c.record(trace.OpSet, hash, false)
+		}
+	}
+
+	return ret, err
+}
+
+func (c *lruWithTrace) Compute(key string, fn func(old interface{}, exists bool) (interface{}, bool)) (interface{}, bool) {
+	var existed bool
+
+	ret, ok := c.parent.Compute(key, func(old interface{}, exists bool) (interface{}, bool) {
+		existed = exists
+		return fn(old, exists)
+	})
+
+	if hash, sampled := c.sample(key); sampled {
+		c.record(trace.OpGet, hash, existed)
+		if ok {
+			c.record(trace.OpSet, hash, existed)
+		} else if existed {
+			c.record(trace.OpDelete, hash, true)
+		}
+	}
+
+	return ret, ok
+}
+
+func (c *lruWithTrace) CompareAndSwap(key string, old, new interface{}) bool {
+	swapped := c.parent.CompareAndSwap(key, old, new)
+	if hash, sampled := c.sample(key); sampled && swapped {
+		c.record(trace.OpSet, hash, true)
+	}
+
+	return swapped
+}
+
+func (c *lruWithTrace) CompareAndDelete(key string, old interface{}) bool {
+	deleted := c.parent.CompareAndDelete(key, old)
+	if hash, sampled := c.sample(key); sampled && deleted {
+		c.record(trace.OpDelete, hash, true)
+	}
+
+	return deleted
+}
+
+func (c *lruWithTrace) GetMany(keys []string) ([]interface{}, []bool) {
+	values, found := c.parent.GetMany(keys)
+
+	for i, key := range keys {
+		if hash, sampled := c.sample(key); sampled {
+			c.record(trace.OpGet, hash, found[i])
+		}
+	}
+
+	return values, found
+}
+
+func (c *lruWithTrace) SetMany(items map[string]interface{}) {
+	// whether keys are replaced is known only before the write
+	var records []sampledRecord
+	for key := range items {
+		if hash, sampled := c.sample(key); sampled {
+			records = append(records, sampledRecord{hash: hash, hit: c.base.Exists(key)})
+		}
+	}
+
+	c.parent.SetMany(items)
+
+	for _, r := range records {
+		c.record(trace.OpSet, r.hash, r.hit)
+	}
+}
+
+func (c *lruWithTrace) DeleteMany(keys []string) int {
+	// only the first occurrence of an existing key deletes it
+	var records []sampledRecord
+	var seen map[string]struct{}
+	for _, key := range keys {
+		hash, sampled := c.sample(key)
+		if !sampled {
+			continue
+		}
+		if seen == nil {
+			seen = make(map[string]struct{})
+		}
+
+		_, dup := seen[key]
+		seen[key] = struct{}{}
+		records = append(records, sampledRecord{hash: hash, hit: !dup && c.base.Exists(key)})
+	}
+
+	ret := c.parent.DeleteMany(keys)
+
+	for _, r := range records {
+		c.record(trace.OpDelete, r.hash, r.hit)
+	}
+
+	return ret
+}
+
+func (c *lruWithTrace) DeleteByPrefix(prefix string) int {
+	return c.parent.DeleteByPrefix(prefix)
+}
+
+func (c *lruWithTrace) DeleteFunc(fn func(key string, value interface{}) bool) int {
+	return c.parent.DeleteFunc(fn)
+}
+
+func (c *lruWithTrace) Purge() {
+	c.parent.Purge()
+}
+
+func (c *lruWithTrace) PurgeWithCallbacks() {
+	c.parent.PurgeWithCallbacks()
+}
+
+func (c *lruWithTrace) TTL(key string) (time.Duration, bool) {
+	return c.parent.TTL(key)
+}
+
+func (c *lruWithTrace) Stats() Stats {
+	return c.parent.Stats()
+}
+
+func (c *lruWithTrace) TopKeys(n int) []HotKey {
+	return c.parent.TopKeys(n)
+}
+
+func (c *lruWithTrace) Destroy() {
+	c.destroyed = true
+	c.parent.Destroy()
+	_ = c.writer.Close()
+}
+
+func (c *lruWithTrace) sample(key string) (uint64, bool) {
+	hash := trace.HashKey(key)
+	return hash, hash <= c.threshold
+}
+
+// sampledRecord is a record of a bulk operation collected before the operation is forwarded
+type sampledRecord struct {
+	hash uint64
+	hit  bool
+}
+
+func (c *lruWithTrace) record(op trace.Op, hash uint64, hit bool) {
+	if c.destroyed {
+		return
+	}
+
+	c.writer.Write(trace.Record{Time: time.Now(), Op: op, KeyHash: hash, Hit: hit})
+}
@@ -0,0 +1,101 @@
+// Package lrutest provides helpers for testing code that uses lru caches
+package lrutest
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a clock moved only by Advance. Pass it to lru.Builder.WithClock to test
+// expiration and background tasks without sleeping. FakeClock is safe for concurrent use
+type FakeClock struct {
+	advanceMu sync.Mutex // serializes Advance calls
+
+	mu    sync.Mutex
+	now   time.Time
+	tasks []*fakeTask
+}
+
+type fakeTask struct {
+	interval time.Duration
+	next     time.Time
+	fn       func()
+	running  sync.Mutex
+}
+
+// NewFakeClock creates a clock showing now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Every schedules fn to be called every d of the fake time. Calls are made by Advance on its goroutine.
+// stop must not be called from fn
+func (c *FakeClock) Every(d time.Duration, fn func()) func() {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.Every")
+	}
+
+	c.mu.Lock()
+	task := &fakeTask{interval: d, next: c.now.Add(d), fn: fn}
+	c.tasks = append(c.tasks, task)
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		for i := range c.tasks {
+			if c.tasks[i] == task {
+				c.tasks = append(c.tasks[:i], c.tasks[i+1:]...)
+				break
+			}
+		}
+		c.mu.Unlock()
+
+		// wait for the running call
+		task.running.Lock()
+		task.running.Unlock()
+	}
+}
+
+// Advance moves the clock forward by d. Tasks due in (now, now+d] are called in order of their time,
+// with the clock showing that time. Tasks due at the same time are called in order of scheduling.
+// Advance returns when all the calls are done
+func (c *FakeClock) Advance(d time.Duration) {
+	c.advanceMu.Lock()
+	defer c.advanceMu.Unlock()
+
+	c.mu.Lock()
+	target := c.now.Add(d)
+
+	for {
+		var due *fakeTask
+		for _, task := range c.tasks {
+			if !task.next.After(target) && (due == nil || task.next.Before(due.next)) {
+				due = task
+			}
+		}
+
+		if due == nil {
+			break
+		}
+
+		c.now = due.next
+		due.next = due.next.Add(due.interval)
+
+		// the task can read the clock
+		due.running.Lock()
+		c.mu.Unlock()
+		due.fn()
+		due.running.Unlock()
+		c.mu.Lock()
+	}
+
+	c.now = target
+	c.mu.Unlock()
+}
@@ -0,0 +1,42 @@
+package lrutest
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_fake_clock_advance(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	var calls []time.Duration
+	stop := clock.Every(time.Second, func() {
+		calls = append(calls, clock.Now().Sub(start))
+	})
+	clock.Every(time.Millisecond*1500, func() {
+		calls = append(calls, -clock.Now().Sub(start))
+	})
+
+	clock.Advance(time.Millisecond * 3200)
+
+	expected := []time.Duration{time.Second, -time.Millisecond * 1500, time.Second * 2, time.Second * 3, -time.Second * 3}
+	if len(calls) != len(expected) {
+		t.Fatalf("expected calls at %v, got %v", expected, calls)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Fatalf("expected calls at %v, got %v", expected, calls)
+		}
+	}
+
+	if clock.Now() != start.Add(time.Millisecond*3200) {
+		t.Errorf("expected clock at %v, got %v", start.Add(time.Millisecond*3200), clock.Now())
+	}
+
+	stop()
+	calls = nil
+	clock.Advance(time.Second)
+	if len(calls) != 0 {
+		t.Errorf("expected no calls after stop, got %v", calls)
+	}
+}
@@ -0,0 +1,248 @@
+package lru
+
+import (
+	"math"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MemoryControllerConfig configures automatic resizing of the cache under memory pressure.
+// Memory usage is the ratio of live heap to the memory limit(GOMEMLIMIT or MemoryLimit when GOMEMLIMIT is not set).
+// When the usage is above HighWatermark, the capacity is decreased by Step share, but not below MinCapacity.
+// When the usage is below LowWatermark, the capacity is increased by Step share, but not above MaxCapacity.
+type MemoryControllerConfig struct {
+	MinCapacity   int           `mapstructure:"min_capacity" json:"min_capacity" yaml:"min_capacity"`
+	MaxCapacity   int           `mapstructure:"max_capacity" json:"max_capacity" yaml:"max_capacity"`
+	Interval      time.Duration `mapstructure:"interval" json:"interval" yaml:"interval"`
+	HighWatermark float64       `mapstructure:"high_watermark" json:"high_watermark" yaml:"high_watermark"`
+	LowWatermark  float64       `mapstructure:"low_watermark" json:"low_watermark" yaml:"low_watermark"`
+	Step          float64       `mapstructure:"step" json:"step" yaml:"step"`
+	MemoryLimit   uint64        `mapstructure:"memory_limit" json:"memory_limit" yaml:"memory_limit"`
+}
+
+func (c *MemoryControllerConfig) Validate() error {
+	// empty config is okay
+	if c == nil {
+		return nil
+	}
+
+	if c.MinCapacity <= 0 {
+		return errors.New("min capacity must be greater than zero")
+	}
+
+	if c.MaxCapacity < c.MinCapacity {
+		return errors.New("max capacity must be greater or equal to min capacity")
+	}
+
+	if c.Interval < 0 {
+		return errors.New("interval must be greater or equal to zero")
+	}
+
+	if c.HighWatermark < 0 || c.HighWatermark > 1 || c.LowWatermark < 0 || c.LowWatermark > 1 {
+		return errors.New("watermarks must be in range [0, 1]")
+	}
+
+	if c.LowWatermark > c.HighWatermark {
+		return errors.New("low watermark must be less or equal to high watermark")
+	}
+
+	if c.Step < 0 || c.Step >= 1 {
+		return errors.New("step must be in range [0, 1)")
+	}
+
+	return nil
+}
+
+func (c MemoryControllerConfig) withDefaults() MemoryControllerConfig {
+	if c.Interval == 0 {
+		c.Interval = time.Second
+	}
+
+	if c.HighWatermark == 0 {
+		c.HighWatermark = 0.9
+	}
+
+	if c.LowWatermark == 0 {
+		c.LowWatermark = 0.7
+	}
+
+	if c.Step == 0 {
+		c.Step = 0.1
+	}
+
+	return c
+}
+
+// lruWithMemoryController is a wrapper for concurrent cache that resizes it in background depending on memory usage
+type lruWithMemoryController struct {
+	Cache
+
+	cfg        MemoryControllerConfig
+	readMemory func() (live uint64, limit uint64, gcCycles uint64)
+	// gcCycles is the number of GC cycles seen by the last adjustment. Live heap is only updated by GC
+	gcCycles uint64
+
+	registration         *metricsRegistration
+	targetCapacityMetric prometheus.Gauge
+	resizesMetric        *prometheus.CounterVec
+
+	clock    Clock
+	stop     func()
+	stopOnce sync.Once
+}
+
+func newWithMemoryController(parent Cache, cfg MemoryControllerConfig, clock Clock) *lruWithMemoryController {
+	// the controller keeps the capacity in [MinCapacity, MaxCapacity] from the start
+	if capacity := parent.Capacity(); capacity < cfg.MinCapacity {
+		parent.Resize(cfg.MinCapacity)
+	} else if capacity > cfg.MaxCapacity {
+		parent.Resize(cfg.MaxCapacity)
+	}
+
+	return &lruWithMemoryController{
+		Cache:      parent,
+		cfg:        cfg.withDefaults(),
+		readMemory: readRuntimeMemory,
+		clock:      clock,
+		stop:       func() {},
+	}
+}
+
+func (c *lruWithMemoryController) registerMetrics(
+	registerer prometheus.Registerer,
+	namespace string,
+	subsystem string,
+	constLabels prometheus.Labels,
+) error {
+	target := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_target_capacity",
+		Help:        "Capacity chosen by the memory controller",
+		ConstLabels: constLabels,
+	})
+	target.Set(float64(c.Capacity()))
+
+	resizes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "cache_resizes_total",
+		Help:        "Total amount of resizes made by the memory controller",
+		ConstLabels: constLabels,
+	}, []string{"direction"})
+
+	c.registration = &metricsRegistration{registerer: registerer}
+	if err := c.registration.register(target, resizes); err != nil {
+		c.registration.unregister()
+		c.registration = nil
+		return err
+	}
+
+	c.targetCapacityMetric = target
+	c.resizesMetric = resizes
+
+	return nil
+}
+
+func (c *lruWithMemoryController) start() {
+	c.stop = c.clock.Every(c.cfg.Interval, c.adjust)
+}
+
+// adjust resizes the cache according to the current memory usage.
+// Live heap doesn't change between GC cycles, so the cache is resized at most once per cycle
+func (c *lruWithMemoryController) adjust() {
+	live, limit, gcCycles := c.readMemory()
+	if gcCycles == c.gcCycles {
+		return
+	}
+	c.gcCycles = gcCycles
+
+	if limit == 0 || limit == math.MaxInt64 {
+		limit = c.cfg.MemoryLimit
+	}
+
+	// no limit - nothing to control
+	if limit == 0 {
+		return
+	}
+
+	usage := float64(live) / float64(limit)
+	capacity := c.Capacity()
+	target := capacity
+
+	switch {
+	case usage > c.cfg.HighWatermark:
+		target = int(float64(capacity) * (1 - c.cfg.Step))
+		if target < c.cfg.MinCapacity {
+			target = c.cfg.MinCapacity
+		}
+	case usage < c.cfg.LowWatermark:
+		target = int(math.Ceil(float64(capacity) * (1 + c.cfg.Step)))
+		if target > c.cfg.MaxCapacity {
+			target = c.cfg.MaxCapacity
+		}
+	}
+
+	if target == capacity {
+		return
+	}
+
+	c.Resize(target)
+
+	if c.targetCapacityMetric != nil {
+		c.targetCapacityMetric.Set(float64(target))
+
+		direction := "grow"
+		if target < capacity {
+			direction = "shrink"
+		}
+		c.resizesMetric.WithLabelValues(direction).Inc()
+	}
+}
+
+func (c *lruWithMemoryController) Destroy() {
+	c.stopOnce.Do(c.stop)
+
+	if c.registration != nil {
+		c.registration.unregister()
+	}
+
+	c.Cache.Destroy()
+}
+
+// readRuntimeMemory returns the live heap size, the memory limit set by GOMEMLIMIT and the number of completed GC cycles
+func readRuntimeMemory() (uint64, uint64, uint64) {
+	samples := []metrics.Sample{
+		{Name: "/gc/heap/live:bytes"},
+		{Name: "/gc/gomemlimit:bytes"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+	}
+	metrics.Read(samples)
+
+	var live, limit, gcCycles uint64
+
+	if samples[0].Value.Kind() == metrics.KindUint64 {
+		live = samples[0].Value.Uint64()
+	} else {
+		// live heap metric is not supported by older runtimes
+		fallback := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		metrics.Read(fallback)
+		if fallback[0].Value.Kind() == metrics.KindUint64 {
+			live = fallback[0].Value.Uint64()
+		}
+	}
+
+	if samples[1].Value.Kind() == metrics.KindUint64 {
+		limit = samples[1].Value.Uint64()
+	}
+
+	if samples[2].Value.Kind() == metrics.KindUint64 {
+		gcCycles = samples[2].Value.Uint64()
+	}
+
+	return live, limit, gcCycles
+}
@@ -1,9 +1,11 @@
 package lru
 
 import (
-	"github.com/pkg/errors"
+	"io"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -14,8 +16,31 @@ type optionMetrics struct {
 	subsystem   string
 	constLabels prometheus.Labels
 }
+type optionMetricsRegisterer struct{ registerer prometheus.Registerer }
+type optionCollector struct {
+	collector *Collector
+	name      string
+}
+type optionLatency struct {
+	buckets    []float64
+	sampleRate float64
+}
 type optionSync struct{}
 type optionDiscreteClock struct{ updateInterval time.Duration }
+type optionClock struct{ clock Clock }
+type optionSegmented struct{ protectedRatio float64 }
+type optionSecondChance struct{}
+type optionConcurrentReads struct{}
+type optionPrefixIndex struct{}
+type optionMemoryController struct{ cfg MemoryControllerConfig }
+type optionHotKeys struct{ cfg HotKeysConfig }
+type optionPriorities struct{ classes int }
+type optionMaxPinned struct{ ratio float64 }
+type optionPinnedExpiration struct{}
+type optionTraceRecorder struct {
+	w          io.Writer
+	sampleRate float64
+}
 type optionSetCallback struct{ cb func(string) }
 type optionDeleteCallback struct{ cb func(string) }
 type optionEvictCallback struct{ cb func(string) }
@@ -26,6 +51,17 @@ type MetricsConfig struct {
 	Namespace string            `mapstructure:"namespace" json:"namespace" yaml:"namespace"`
 	Subsystem string            `mapstructure:"subsystem" json:"subsystem" yaml:"subsystem"`
 	Labels    map[string]string `mapstructure:"labels" json:"labels" yaml:"labels"`
+	// Latency enables histograms of lock wait and operation time. Optional
+	Latency *LatencyConfig `mapstructure:"latency" json:"latency" yaml:"latency"`
+	// Registerer is a registry for metrics. Default is prometheus.DefaultRegisterer
+	Registerer prometheus.Registerer `mapstructure:"-" json:"-" yaml:"-"`
+}
+
+type LatencyConfig struct {
+	// Buckets of histograms in seconds. Default covers 100ns..26ms
+	Buckets []float64 `mapstructure:"buckets" json:"buckets" yaml:"buckets"`
+	// SampleRate is the share of timed operations. Default is 0.01
+	SampleRate float64 `mapstructure:"sample_rate" json:"sample_rate" yaml:"sample_rate"`
 }
 
 type ClockConfig struct {
@@ -38,12 +74,37 @@ type ClockConfigDiscrete struct {
 	UpdateInterval time.Duration `mapstructure:"update_interval" json:"update_interval" yaml:"update_interval"`
 }
 
+type PolicyConfig struct {
+	LRU          *PolicyConfigLRU          `mapstructure:"lru" json:"lru" yaml:"lru"`
+	Segmented    *PolicyConfigSegmented    `mapstructure:"segmented" json:"segmented" yaml:"segmented"`
+	SecondChance *PolicyConfigSecondChance `mapstructure:"second_chance" json:"second_chance" yaml:"second_chance"`
+}
+
+type PolicyConfigLRU struct{}
+type PolicyConfigSegmented struct {
+	ProtectedRatio float64 `mapstructure:"protected_ratio" json:"protected_ratio" yaml:"protected_ratio"`
+}
+type PolicyConfigSecondChance struct{}
+
+type PinningConfig struct {
+	MaxRatio float64 `mapstructure:"max_ratio" json:"max_ratio" yaml:"max_ratio"`
+	Expire   bool    `mapstructure:"expire" json:"expire" yaml:"expire"`
+}
+
 type Config struct {
-	Capacity   int            `mapstructure:"capacity" json:"capacity" yaml:"capacity"`
-	TTL        time.Duration  `mapstructure:"ttl" json:"ttl" yaml:"ttl"`
-	Concurrent bool           `mapstructure:"concurrent" json:"concurrent" yaml:"concurrent"`
-	Metrics    *MetricsConfig `mapstructure:"metrics" json:"metrics" yaml:"metrics"`
-	Clock      *ClockConfig   `mapstructure:"clock" json:"clock" yaml:"clock"`
+	Capacity    int            `mapstructure:"capacity" json:"capacity" yaml:"capacity"`
+	TTL         time.Duration  `mapstructure:"ttl" json:"ttl" yaml:"ttl"`
+	Concurrent  bool           `mapstructure:"concurrent" json:"concurrent" yaml:"concurrent"`
+	Metrics     *MetricsConfig `mapstructure:"metrics" json:"metrics" yaml:"metrics"`
+	Clock       *ClockConfig   `mapstructure:"clock" json:"clock" yaml:"clock"`
+	Policy      *PolicyConfig  `mapstructure:"policy" json:"policy" yaml:"policy"`
+	Pinning     *PinningConfig `mapstructure:"pinning" json:"pinning" yaml:"pinning"`
+	Priorities  int            `mapstructure:"priorities" json:"priorities" yaml:"priorities"`
+	PrefixIndex bool           `mapstructure:"prefix_index" json:"prefix_index" yaml:"prefix_index"`
+
+	ConcurrentReads  bool                    `mapstructure:"concurrent_reads" json:"concurrent_reads" yaml:"concurrent_reads"`
+	MemoryController *MemoryControllerConfig `mapstructure:"memory_controller" json:"memory_controller" yaml:"memory_controller"`
+	HotKeys          *HotKeysConfig          `mapstructure:"hot_keys" json:"hot_keys" yaml:"hot_keys"`
 }
 
 func (c *Config) Validate() error {
@@ -57,6 +118,10 @@ func (c *Config) Validate() error {
 		return errors.New("capacity must be greater than zero")
 	}
 
+	if c.Priorities < 0 {
+		return errors.New("priorities must be greater or equal to zero")
+	}
+
 	if err := c.Metrics.Validate(); err != nil {
 		return err
 	}
@@ -65,6 +130,34 @@ func (c *Config) Validate() error {
 		return err
 	}
 
+	if err := c.Policy.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Pinning.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.MemoryController.Validate(); err != nil {
+		return errors.Wrap(err, "memory controller")
+	}
+
+	if err := c.HotKeys.Validate(); err != nil {
+		return errors.Wrap(err, "hot keys")
+	}
+
+	if c.ConcurrentReads && !c.Concurrent {
+		return errors.New("concurrent reads require concurrent cache")
+	}
+
+	if c.MemoryController != nil && !c.Concurrent {
+		return errors.New("memory controller requires concurrent cache")
+	}
+
+	if c.Metrics != nil && c.Metrics.Enabled && c.Metrics.Latency != nil && !c.Concurrent {
+		return errors.New("latency histograms require concurrent cache")
+	}
+
 	return nil
 }
 
@@ -86,6 +179,23 @@ func (c *MetricsConfig) Validate() error {
 		return errors.New("metrics subsystem is empty")
 	}
 
+	if err := c.Latency.Validate(); err != nil {
+		return errors.Wrap(err, "latency")
+	}
+
+	return nil
+}
+
+func (c *LatencyConfig) Validate() error {
+	// empty config is okay
+	if c == nil {
+		return nil
+	}
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return errors.New("sample rate must be in range [0, 1]")
+	}
+
 	return nil
 }
 
@@ -126,6 +236,71 @@ func (c *ClockConfigDiscrete) Validate() error {
 	return nil
 }
 
+func (c *PolicyConfig) Validate() error {
+	// empty config is okay
+	if c == nil {
+		return nil
+	}
+
+	policyConfigsFound := 0
+
+	if c.LRU != nil {
+		policyConfigsFound++
+		if err := c.LRU.Validate(); err != nil {
+			return errors.Wrap(err, "lru")
+		}
+	}
+
+	if c.Segmented != nil {
+		policyConfigsFound++
+		if err := c.Segmented.Validate(); err != nil {
+			return errors.Wrap(err, "segmented")
+		}
+	}
+
+	if c.SecondChance != nil {
+		policyConfigsFound++
+		if err := c.SecondChance.Validate(); err != nil {
+			return errors.Wrap(err, "second chance")
+		}
+	}
+
+	if policyConfigsFound != 1 {
+		return errors.New("exactly one policy config expected")
+	}
+
+	return nil
+}
+
+func (c *PolicyConfigLRU) Validate() error {
+	return nil
+}
+
+func (c *PolicyConfigSegmented) Validate() error {
+	if c.ProtectedRatio <= 0 || c.ProtectedRatio >= 1 {
+		return errors.New("protected ratio must be between zero and one")
+	}
+
+	return nil
+}
+
+func (c *PolicyConfigSecondChance) Validate() error {
+	return nil
+}
+
+func (c *PinningConfig) Validate() error {
+	// empty config is okay
+	if c == nil {
+		return nil
+	}
+
+	if c.MaxRatio < 0 || c.MaxRatio >= 1 {
+		return errors.New("max pinned ratio must be in range [0, 1)")
+	}
+
+	return nil
+}
+
 func (c *Config) withDefaults() *Config {
 	var ret = *c
 	if ret.Metrics == nil {
@@ -140,5 +315,17 @@ func (c *Config) withDefaults() *Config {
 		}
 	}
 
+	if ret.Policy == nil {
+		ret.Policy = &PolicyConfig{
+			LRU: &PolicyConfigLRU{},
+		}
+	}
+
+	if ret.Pinning == nil {
+		ret.Pinning = &PinningConfig{
+			MaxRatio: defaultMaxPinnedRatio,
+		}
+	}
+
 	return &ret
 }
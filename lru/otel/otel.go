@@ -0,0 +1,187 @@
+// Package otel reports statistics of lru caches as OpenTelemetry metrics and traces GetOrLoad loader calls.
+package otel
+
+import (
+	"context"
+
+	"github.com/pavel-krush/cache/v2/lru"
+	"github.com/pkg/errors"
+	gootel "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/pavel-krush/cache/v2/lru/otel"
+
+type config struct {
+	name           string
+	meterProvider  metric.MeterProvider
+	tracerProvider trace.TracerProvider
+}
+
+type Option func(*config)
+
+// WithName sets the cache.name attribute of metrics and spans
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// WithMeterProvider sets the meter provider. Default is the global one
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(c *config) {
+		c.meterProvider = provider
+	}
+}
+
+// WithTracerProvider enables spans for loader calls made by GetOrLoad
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = provider
+	}
+}
+
+// Cache is a wrapper for lru.Cache that reports its statistics as OpenTelemetry metrics.
+// Values are read from lru.Cache.Stats() on collection, so cache operations don't update instruments
+type Cache struct {
+	lru.Cache
+
+	tracer       trace.Tracer
+	attributes   []attribute.KeyValue
+	registration metric.Registration
+}
+
+// Wrap creates a wrapper for the cache. The wrapper must be destroyed instead of the cache
+func Wrap(cache lru.Cache, opts ...Option) (*Cache, error) {
+	cfg := config{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.meterProvider == nil {
+		cfg.meterProvider = gootel.GetMeterProvider()
+	}
+
+	ret := &Cache{Cache: cache}
+
+	if cfg.name != "" {
+		ret.attributes = []attribute.KeyValue{attribute.String("cache.name", cfg.name)}
+	}
+
+	if cfg.tracerProvider != nil {
+		ret.tracer = cfg.tracerProvider.Tracer(instrumentationName)
+	}
+
+	if err := ret.registerMetrics(cfg.meterProvider.Meter(instrumentationName)); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (c *Cache) registerMetrics(meter metric.Meter) error {
+	// the first error is returned, instruments are still created, they are no-op on error
+	var err error
+
+	counter := func(name string, description string) metric.Int64ObservableCounter {
+		ret, counterErr := meter.Int64ObservableCounter(name, metric.WithDescription(description))
+		if err == nil {
+			err = counterErr
+		}
+		return ret
+	}
+
+	gauge := func(name string, description string) metric.Int64ObservableGauge {
+		ret, gaugeErr := meter.Int64ObservableGauge(name, metric.WithDescription(description))
+		if err == nil {
+			err = gaugeErr
+		}
+		return ret
+	}
+
+	var (
+		hits        = counter("cache.hits", "Total amount of cache hits")
+		misses      = counter("cache.misses", "Total amount of cache misses")
+		sets        = counter("cache.sets", "Total amount of writes")
+		deletes     = counter("cache.deletes", "Total amount of deleted keys")
+		evictions   = counter("cache.evictions", "Total amount of keys evicted by cache overflow")
+		expirations = counter("cache.expirations", "Total amount of expired keys")
+		loads       = counter("cache.loads", "Total amount of GetOrLoad loader calls")
+		size        = gauge("cache.size", "Number of items in cache")
+		capacity    = gauge("cache.capacity", "Maximum number of items in cache")
+	)
+	if err != nil {
+		return errors.Wrap(err, "create instrument")
+	}
+
+	attributes := metric.WithAttributes(c.attributes...)
+	loadSuccess := metric.WithAttributes(append([]attribute.KeyValue{attribute.String("result", "success")}, c.attributes...)...)
+	loadFailure := metric.WithAttributes(append([]attribute.KeyValue{attribute.String("result", "failure")}, c.attributes...)...)
+
+	c.registration, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		stats := c.Stats()
+
+		o.ObserveInt64(hits, int64(stats.Hits), attributes)
+		o.ObserveInt64(misses, int64(stats.Misses), attributes)
+		o.ObserveInt64(sets, int64(stats.Sets), attributes)
+		o.ObserveInt64(deletes, int64(stats.Deletes), attributes)
+		o.ObserveInt64(evictions, int64(stats.Evictions), attributes)
+		o.ObserveInt64(expirations, int64(stats.Expirations), attributes)
+		o.ObserveInt64(loads, int64(stats.LoadSuccesses), loadSuccess)
+		o.ObserveInt64(loads, int64(stats.LoadFailures), loadFailure)
+		o.ObserveInt64(size, int64(stats.Size), attributes)
+		o.ObserveInt64(capacity, int64(c.Capacity()), attributes)
+
+		return nil
+	}, hits, misses, sets, deletes, evictions, expirations, loads, size, capacity)
+	if err != nil {
+		return errors.Wrap(err, "register callback")
+	}
+
+	return nil
+}
+
+// GetOrLoad is the same as GetOrLoadContext with background context
+func (c *Cache) GetOrLoad(key string, load func(key string) (interface{}, error)) (interface{}, error) {
+	return c.GetOrLoadContext(context.Background(), key, func(_ context.Context, key string) (interface{}, error) {
+		return load(key)
+	})
+}
+
+// GetOrLoadContext returns the value of the key if present. Otherwise, it stores and returns the value returned by load.
+// When tracing is enabled, the loader call is wrapped in a span, a child of ctx
+func (c *Cache) GetOrLoadContext(
+	ctx context.Context,
+	key string,
+	load func(ctx context.Context, key string) (interface{}, error),
+) (interface{}, error) {
+	if c.tracer == nil {
+		return c.Cache.GetOrLoad(key, func(key string) (interface{}, error) {
+			return load(ctx, key)
+		})
+	}
+
+	return c.Cache.GetOrLoad(key, func(key string) (interface{}, error) {
+		ctx, span := c.tracer.Start(ctx, "lru.load", trace.WithAttributes(c.attributes...))
+		defer span.End()
+
+		value, err := load(ctx, key)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return value, err
+	})
+}
+
+func (c *Cache) Destroy() {
+	if err := c.registration.Unregister(); err != nil {
+		gootel.Handle(err)
+	}
+
+	c.Cache.Destroy()
+}
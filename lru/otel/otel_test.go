@@ -0,0 +1,131 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pavel-krush/cache/v2/lru"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func collect(t *testing.T, reader sdkmetric.Reader) map[string]int64 {
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+
+	ret := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			var points []metricdata.DataPoint[int64]
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				points = data.DataPoints
+			case metricdata.Gauge[int64]:
+				points = data.DataPoints
+			}
+
+			for _, point := range points {
+				if name, _ := point.Attributes.Value("cache.name"); name.AsString() != "users" {
+					t.Errorf("unexpected cache.name of %s: %q", m.Name, name.AsString())
+				}
+
+				key := m.Name
+				if result, found := point.Attributes.Value("result"); found {
+					key += "." + result.AsString()
+				}
+				ret[key] = point.Value
+			}
+		}
+	}
+
+	return ret
+}
+
+func Test_Wrap(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	spans := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+
+	c, err := Wrap(lru.New().WithCapacity(2).WithSync().Build(),
+		WithName("users"), WithMeterProvider(meterProvider), WithTracerProvider(tracerProvider))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	c.Get("a")
+	c.Get("c")
+
+	loadErr := errors.New("load failed")
+	if _, err := c.GetOrLoad("d", func(string) (interface{}, error) { return nil, loadErr }); err != loadErr {
+		t.Errorf("expected load error, got %v", err)
+	}
+
+	value, err := c.GetOrLoadContext(context.Background(), "d", func(context.Context, string) (interface{}, error) {
+		return 4, nil
+	})
+	if err != nil || value != 4 {
+		t.Errorf("expected loaded value, got %v, %v", value, err)
+	}
+
+	// hit doesn't call the loader
+	if _, err := c.GetOrLoad("d", func(string) (interface{}, error) { return nil, loadErr }); err != nil {
+		t.Errorf("expected cached value, got %v", err)
+	}
+
+	expected := map[string]int64{
+		"cache.hits":          2,
+		"cache.misses":        3,
+		"cache.sets":          4,
+		"cache.deletes":       0,
+		"cache.evictions":     2,
+		"cache.expirations":   0,
+		"cache.loads.success": 1,
+		"cache.loads.failure": 1,
+		"cache.size":          2,
+		"cache.capacity":      2,
+	}
+
+	got := collect(t, reader)
+	for name, value := range expected {
+		if got[name] != value {
+			t.Errorf("expected %s = %d, got %d", name, value, got[name])
+		}
+	}
+
+	ended := spans.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 loader spans, got %d", len(ended))
+	}
+
+	if ended[0].Name() != "lru.load" || ended[0].Status().Code != codes.Error {
+		t.Errorf("expected failed lru.load span, got %s %v", ended[0].Name(), ended[0].Status())
+	}
+
+	if ended[1].Status().Code == codes.Error {
+		t.Errorf("expected successful span, got %v", ended[1].Status())
+	}
+
+	for _, attr := range ended[1].Attributes() {
+		if attr.Key == "cache.name" && attr.Value != attribute.StringValue("users") {
+			t.Errorf("unexpected span attribute %v", attr)
+		}
+	}
+
+	// destroyed cache is not reported
+	c.Destroy()
+
+	if got := collect(t, reader); len(got) != 0 {
+		t.Errorf("expected no metrics after destroy, got %v", got)
+	}
+}
@@ -0,0 +1,64 @@
+package lru
+
+import (
+	"github.com/pavel-krush/cache/v2/lru/queue"
+)
+
+// policy decides which key should be evicted when the cache is full
+type policy interface {
+	// Push is called when the key is written to the cache
+	Push(key string)
+	// Access is called when the key is successfully read from the cache
+	Access(key string)
+	// Delete forgets the key
+	Delete(key string)
+	// Shift extracts the key that should be evicted next
+	Shift() (string, bool)
+	// Range calls fn for each key in eviction order, starting from the next victim
+	Range(fn func(key string) bool)
+	// RangeReverse calls fn for each key in reverse eviction order
+	RangeReverse(fn func(key string) bool)
+	// Reset forgets all keys
+	Reset()
+	// Resize changes the maximum number of keys. The policy must not contain more keys than the new capacity
+	Resize(capacity int)
+}
+
+// policyLRU is a default policy. Keys are ordered by the time of the last write
+type policyLRU struct {
+	queue *queue.Queue
+}
+
+func newPolicyLRU(capacity int) policy {
+	return &policyLRU{queue: queue.New(capacity)}
+}
+
+func (p *policyLRU) Push(key string) {
+	p.queue.Push(key)
+}
+
+func (p *policyLRU) Access(string) {}
+
+func (p *policyLRU) Delete(key string) {
+	p.queue.Delete(key)
+}
+
+func (p *policyLRU) Shift() (string, bool) {
+	return p.queue.Shift()
+}
+
+func (p *policyLRU) Range(fn func(key string) bool) {
+	p.queue.Range(fn)
+}
+
+func (p *policyLRU) RangeReverse(fn func(key string) bool) {
+	p.queue.RangeReverse(fn)
+}
+
+func (p *policyLRU) Reset() {
+	p.queue.Reset()
+}
+
+func (p *policyLRU) Resize(capacity int) {
+	p.queue.Resize(capacity)
+}
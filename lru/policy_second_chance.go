@@ -0,0 +1,163 @@
+package lru
+
+import (
+	"sync/atomic"
+)
+
+// policySecondChance is a CLOCK(second chance) policy.
+// Keys are placed on a ring. Reading a key only sets its reference bit atomically, so Access is safe
+// to call concurrently with other Access calls. When a victim is required, the hand sweeps the ring,
+// clearing reference bits, and evicts the first key that has not been referenced since the previous sweep.
+type policySecondChance struct {
+	keys       []string
+	referenced []uint32
+	index      map[string]int
+	free       []int
+	hand       int
+}
+
+func newPolicySecondChance(capacity int) *policySecondChance {
+	ret := &policySecondChance{
+		keys:       make([]string, capacity),
+		referenced: make([]uint32, capacity),
+		index:      make(map[string]int, capacity),
+		free:       make([]int, capacity),
+	}
+
+	// mark all slots as free, lowest slots are taken first
+	for i := 0; i < capacity; i++ {
+		ret.free[i] = capacity - i - 1
+	}
+
+	return ret
+}
+
+func (p *policySecondChance) Push(key string) {
+	if slot, ok := p.index[key]; ok {
+		atomic.StoreUint32(&p.referenced[slot], 1)
+		return
+	}
+
+	freeLen := len(p.free)
+	if freeLen == 0 {
+		panic("policy full")
+	}
+
+	slot := p.free[freeLen-1]
+	p.free = p.free[:freeLen-1]
+
+	p.keys[slot] = key
+	atomic.StoreUint32(&p.referenced[slot], 0)
+	p.index[key] = slot
+}
+
+func (p *policySecondChance) Access(key string) {
+	if slot, ok := p.index[key]; ok {
+		atomic.StoreUint32(&p.referenced[slot], 1)
+	}
+}
+
+func (p *policySecondChance) Delete(key string) {
+	slot, ok := p.index[key]
+	if !ok {
+		return
+	}
+
+	delete(p.index, key)
+	p.keys[slot] = ""
+	p.free = append(p.free, slot)
+}
+
+func (p *policySecondChance) Shift() (string, bool) {
+	if len(p.index) == 0 {
+		return "", false
+	}
+
+	// every referenced key gets its bit cleared on the first pass,
+	// so the victim is found in at most two rounds
+	for {
+		slot := p.hand
+		p.hand = (p.hand + 1) % len(p.keys)
+
+		// skip free slots
+		if s, ok := p.index[p.keys[slot]]; !ok || s != slot {
+			continue
+		}
+
+		if atomic.CompareAndSwapUint32(&p.referenced[slot], 1, 0) {
+			continue
+		}
+
+		key := p.keys[slot]
+		p.Delete(key)
+
+		return key, true
+	}
+}
+
+// Range walks the ring starting from the hand. Reference bits are not taken into account
+func (p *policySecondChance) Range(fn func(key string) bool) {
+	for i := 0; i < len(p.keys); i++ {
+		slot := (p.hand + i) % len(p.keys)
+		if s, ok := p.index[p.keys[slot]]; !ok || s != slot {
+			continue
+		}
+
+		if !fn(p.keys[slot]) {
+			return
+		}
+	}
+}
+
+func (p *policySecondChance) RangeReverse(fn func(key string) bool) {
+	for i := len(p.keys) - 1; i >= 0; i-- {
+		slot := (p.hand + i) % len(p.keys)
+		if s, ok := p.index[p.keys[slot]]; !ok || s != slot {
+			continue
+		}
+
+		if !fn(p.keys[slot]) {
+			return
+		}
+	}
+}
+
+func (p *policySecondChance) Reset() {
+	capacity := len(p.keys)
+
+	p.index = make(map[string]int, capacity)
+	p.free = p.free[:capacity]
+	for i := 0; i < capacity; i++ {
+		p.keys[i] = ""
+		p.free[i] = capacity - i - 1
+	}
+	p.hand = 0
+}
+
+// Resize rebuilds the ring keeping the order of keys and their reference bits
+func (p *policySecondChance) Resize(capacity int) {
+	if len(p.index) > capacity {
+		panic("policy too large")
+	}
+
+	var (
+		keys       []string
+		referenced []uint32
+	)
+
+	p.Range(func(key string) bool {
+		keys = append(keys, key)
+		referenced = append(referenced, atomic.LoadUint32(&p.referenced[p.index[key]]))
+		return true
+	})
+
+	p.keys = make([]string, capacity)
+	p.referenced = make([]uint32, capacity)
+	p.free = make([]int, capacity)
+	p.Reset()
+
+	for i, key := range keys {
+		p.Push(key)
+		p.referenced[p.index[key]] = referenced[i]
+	}
+}
@@ -0,0 +1,169 @@
+package lru
+
+import (
+	"sync/atomic"
+
+	"github.com/pavel-krush/cache/v2/lru/queue"
+)
+
+// policySegmented is a segmented LRU policy.
+// New keys enter the probation segment. The second hit promotes the key to the protected segment.
+// When the protected segment overflows, its oldest key is demoted back to the probation segment.
+// Victims are taken from the probation segment first, so one-time scans can't flush frequently used keys.
+type policySegmented struct {
+	probation *queue.Queue
+	protected *queue.Queue
+
+	protectedRatio    float64
+	protectedCapacity int
+
+	// segment sizes are stored atomically to be read by metrics without locking
+	probationLen int64
+	protectedLen int64
+
+	onPromote func(string)
+	onDemote  func(string)
+}
+
+func newPolicySegmented(capacity int, protectedRatio float64) *policySegmented {
+	protectedCapacity := segmentedProtectedCapacity(capacity, protectedRatio)
+
+	return &policySegmented{
+		probation:         queue.New(capacity),
+		protected:         queue.New(protectedCapacity),
+		protectedRatio:    protectedRatio,
+		protectedCapacity: protectedCapacity,
+	}
+}
+
+func segmentedProtectedCapacity(capacity int, protectedRatio float64) int {
+	ret := int(float64(capacity) * protectedRatio)
+	if ret < 1 {
+		ret = 1
+	}
+
+	return ret
+}
+
+func (p *policySegmented) Push(key string) {
+	// overwriting an existing key counts as a hit
+	if p.probation.Exists(key) || p.protected.Exists(key) {
+		p.Access(key)
+		return
+	}
+
+	p.probation.Push(key)
+	p.updateLen()
+}
+
+func (p *policySegmented) Access(key string) {
+	if p.protected.Exists(key) {
+		p.protected.MoveToEnd(key)
+		return
+	}
+
+	if !p.probation.Exists(key) {
+		return
+	}
+
+	p.probation.Delete(key)
+
+	// make room in the protected segment
+	if p.protected.Len() >= p.protectedCapacity {
+		demoted, _ := p.protected.Shift()
+		p.probation.Push(demoted)
+
+		if p.onDemote != nil {
+			p.onDemote(demoted)
+		}
+	}
+
+	p.protected.Push(key)
+	p.updateLen()
+
+	if p.onPromote != nil {
+		p.onPromote(key)
+	}
+}
+
+func (p *policySegmented) Delete(key string) {
+	p.probation.Delete(key)
+	p.protected.Delete(key)
+	p.updateLen()
+}
+
+func (p *policySegmented) Shift() (string, bool) {
+	key, found := p.probation.Shift()
+	if !found {
+		key, found = p.protected.Shift()
+	}
+
+	p.updateLen()
+
+	return key, found
+}
+
+func (p *policySegmented) Range(fn func(key string) bool) {
+	stopped := false
+	p.probation.Range(func(key string) bool {
+		stopped = !fn(key)
+		return !stopped
+	})
+
+	if !stopped {
+		p.protected.Range(fn)
+	}
+}
+
+func (p *policySegmented) RangeReverse(fn func(key string) bool) {
+	stopped := false
+	p.protected.RangeReverse(func(key string) bool {
+		stopped = !fn(key)
+		return !stopped
+	})
+
+	if !stopped {
+		p.probation.RangeReverse(fn)
+	}
+}
+
+func (p *policySegmented) Reset() {
+	p.probation.Reset()
+	p.protected.Reset()
+	p.updateLen()
+}
+
+// Resize keeps the share of the protected segment. Excess protected keys are demoted
+func (p *policySegmented) Resize(capacity int) {
+	protectedCapacity := segmentedProtectedCapacity(capacity, p.protectedRatio)
+
+	p.probation.Resize(capacity)
+
+	for p.protected.Len() > protectedCapacity {
+		demoted, _ := p.protected.Shift()
+		p.probation.Push(demoted)
+
+		if p.onDemote != nil {
+			p.onDemote(demoted)
+		}
+	}
+
+	p.protected.Resize(protectedCapacity)
+	p.protectedCapacity = protectedCapacity
+	p.updateLen()
+}
+
+// ProbationLen returns the number of keys in the probation segment
+func (p *policySegmented) ProbationLen() int {
+	return int(atomic.LoadInt64(&p.probationLen))
+}
+
+// ProtectedLen returns the number of keys in the protected segment
+func (p *policySegmented) ProtectedLen() int {
+	return int(atomic.LoadInt64(&p.protectedLen))
+}
+
+func (p *policySegmented) updateLen() {
+	atomic.StoreInt64(&p.probationLen, int64(p.probation.Len()))
+	atomic.StoreInt64(&p.protectedLen, int64(p.protected.Len()))
+}
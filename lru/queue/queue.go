@@ -34,6 +34,38 @@ func New(capacity int) *Queue {
 	return ret
 }
 
+// Reset removes all elements from the queue without reallocating it
+func (q *Queue) Reset() {
+	q.keys = make(map[string]int)
+	q.free = q.free[:cap(q.free)]
+	for i := range q.free {
+		q.free[i] = i
+	}
+	q.head = 0
+}
+
+// Resize changes the capacity of the queue keeping the order of elements.
+// The queue must not contain more elements than the new capacity
+func (q *Queue) Resize(capacity int) {
+	if len(q.keys) > capacity {
+		panic("queue too large")
+	}
+
+	keys := make([]string, 0, len(q.keys))
+	q.Range(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	q.list = make([]queueItem, capacity)
+	q.free = make([]int, capacity)
+	q.Reset()
+
+	for _, key := range keys {
+		q.Push(key)
+	}
+}
+
 // Push puts a new element into the end of the queue
 func (q *Queue) Push(key string) {
 	if _, ok := q.keys[key]; ok {
@@ -121,6 +153,58 @@ func (q *Queue) Peek() (string, bool) {
 	return q.list[q.head].key, true
 }
 
+// Exists checks whether given element is in the queue
+func (q *Queue) Exists(key string) bool {
+	_, ok := q.keys[key]
+	return ok
+}
+
+// Len returns the number of elements in the queue
+func (q *Queue) Len() int {
+	return len(q.keys)
+}
+
+// Range calls fn for each element from the first to the last one. Stops when fn returns false.
+// The queue must not be modified by fn
+func (q *Queue) Range(fn func(key string) bool) {
+	if len(q.keys) == 0 {
+		return
+	}
+
+	index := q.head
+	for {
+		if !fn(q.list[index].key) {
+			return
+		}
+
+		index = q.list[index].right
+		if index == q.head {
+			return
+		}
+	}
+}
+
+// RangeReverse calls fn for each element from the last to the first one. Stops when fn returns false.
+// The queue must not be modified by fn
+func (q *Queue) RangeReverse(fn func(key string) bool) {
+	if len(q.keys) == 0 {
+		return
+	}
+
+	last := q.list[q.head].left
+	index := last
+	for {
+		if !fn(q.list[index].key) {
+			return
+		}
+
+		index = q.list[index].left
+		if index == last {
+			return
+		}
+	}
+}
+
 // MoveToEnd makes given element to be the last element in the queue
 func (q *Queue) MoveToEnd(key string) {
 	q.Delete(key)
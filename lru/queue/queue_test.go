@@ -5,6 +5,58 @@ import (
 	"testing"
 )
 
+func Test_queue_range(t *testing.T) {
+	q := New(5)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		q.Push(key)
+	}
+	q.Delete("b")
+	q.MoveToEnd("a")
+
+	var forward, backward []string
+	q.Range(func(key string) bool {
+		forward = append(forward, key)
+		return true
+	})
+	q.RangeReverse(func(key string) bool {
+		backward = append(backward, key)
+		return true
+	})
+
+	if fmt.Sprint(forward) != "[c d a]" {
+		t.Errorf("unexpected forward order %v", forward)
+	}
+	if fmt.Sprint(backward) != "[a d c]" {
+		t.Errorf("unexpected backward order %v", backward)
+	}
+}
+
+func Test_queue_resize(t *testing.T) {
+	q := New(3)
+	for _, key := range []string{"a", "b", "c"} {
+		q.Push(key)
+	}
+	q.Shift()
+
+	q.Resize(5)
+	for _, key := range []string{"d", "e", "f"} {
+		q.Push(key)
+	}
+
+	q.Shift()
+	q.Resize(4)
+
+	var keys []string
+	q.Range(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	if fmt.Sprint(keys) != "[c d e f]" {
+		t.Errorf("unexpected order after resize %v", keys)
+	}
+}
+
 func Benchmark_queue(b *testing.B) {
 	size := b.N
 
@@ -0,0 +1,202 @@
+package radix
+
+import (
+	"strings"
+)
+
+// Tree is a radix tree of string keys. It allows to find all keys with given prefix
+// without scanning the whole key set
+type Tree struct {
+	root node
+	size int
+}
+
+type node struct {
+	prefix   string  // prefix is the label of the edge leading to the node
+	leaf     bool    // leaf is true when the path to the node is a stored key
+	children []*node // children are sorted by the first byte of their prefix
+}
+
+func New() *Tree {
+	return &Tree{}
+}
+
+// Len returns the number of keys in the tree
+func (t *Tree) Len() int {
+	return t.size
+}
+
+// Insert adds the key to the tree. Returns false if the key already exists
+func (t *Tree) Insert(key string) bool {
+	n := &t.root
+	search := key
+
+	for {
+		if len(search) == 0 {
+			if n.leaf {
+				return false
+			}
+
+			n.leaf = true
+			t.size++
+			return true
+		}
+
+		child, index := n.child(search[0])
+		if child == nil {
+			n.addChild(&node{prefix: search, leaf: true})
+			t.size++
+			return true
+		}
+
+		common := commonPrefixLen(search, child.prefix)
+		if common == len(child.prefix) {
+			n = child
+			search = search[common:]
+			continue
+		}
+
+		// the key diverges in the middle of the edge, split it
+		split := &node{prefix: search[:common]}
+		child.prefix = child.prefix[common:]
+		split.addChild(child)
+		n.children[index] = split
+
+		search = search[common:]
+		if len(search) == 0 {
+			split.leaf = true
+		} else {
+			split.addChild(&node{prefix: search, leaf: true})
+		}
+
+		t.size++
+		return true
+	}
+}
+
+// Delete removes the key from the tree. Returns false if the key doesn't exist
+func (t *Tree) Delete(key string) bool {
+	var (
+		parent *node
+		index  int
+	)
+
+	n := &t.root
+	search := key
+
+	for len(search) > 0 {
+		child, i := n.child(search[0])
+		if child == nil || !strings.HasPrefix(search, child.prefix) {
+			return false
+		}
+
+		parent, index = n, i
+		n = child
+		search = search[len(child.prefix):]
+	}
+
+	if !n.leaf {
+		return false
+	}
+
+	n.leaf = false
+	t.size--
+
+	// root is never removed or merged
+	if parent == nil {
+		return true
+	}
+
+	switch len(n.children) {
+	case 0:
+		parent.children = append(parent.children[:index], parent.children[index+1:]...)
+		if parent != &t.root && !parent.leaf && len(parent.children) == 1 {
+			parent.mergeChild()
+		}
+	case 1:
+		n.mergeChild()
+	}
+
+	return true
+}
+
+// WalkPrefix calls fn for each key that starts with the prefix in lexicographical order.
+// Stops when fn returns false. The tree must not be modified by fn
+func (t *Tree) WalkPrefix(prefix string, fn func(key string) bool) {
+	n := &t.root
+	search := prefix
+	path := ""
+
+	for len(search) > 0 {
+		child, _ := n.child(search[0])
+		if child == nil {
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(search, child.prefix):
+			search = search[len(child.prefix):]
+		case strings.HasPrefix(child.prefix, search):
+			search = ""
+		default:
+			return
+		}
+
+		path += child.prefix
+		n = child
+	}
+
+	n.walk(path, fn)
+}
+
+func (n *node) walk(path string, fn func(key string) bool) bool {
+	if n.leaf && !fn(path) {
+		return false
+	}
+
+	for _, child := range n.children {
+		if !child.walk(path+child.prefix, fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (n *node) child(b byte) (*node, int) {
+	for i, child := range n.children {
+		if child.prefix[0] == b {
+			return child, i
+		}
+	}
+
+	return nil, -1
+}
+
+func (n *node) addChild(child *node) {
+	i := 0
+	for i < len(n.children) && n.children[i].prefix[0] < child.prefix[0] {
+		i++
+	}
+
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+// mergeChild merges the only child into the node
+func (n *node) mergeChild() {
+	child := n.children[0]
+	n.prefix += child.prefix
+	n.leaf = child.leaf
+	n.children = child.children
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
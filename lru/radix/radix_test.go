@@ -0,0 +1,90 @@
+package radix
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func walk(t *Tree, prefix string) []string {
+	var ret []string
+	t.WalkPrefix(prefix, func(key string) bool {
+		ret = append(ret, key)
+		return true
+	})
+
+	return ret
+}
+
+func Test_radix_basic(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"tenant1:a", "tenant1:b", "tenant10:a", "tenant2:a", "t", ""} {
+		if !tree.Insert(key) {
+			t.Errorf("expected key \"%s\" inserted", key)
+		}
+	}
+
+	if tree.Insert("tenant1:a") {
+		t.Errorf("expected duplicate insert to fail")
+	}
+
+	if got := fmt.Sprint(walk(tree, "tenant1:")); got != "[tenant1:a tenant1:b]" {
+		t.Errorf("unexpected walk result %s", got)
+	}
+
+	if got := fmt.Sprint(walk(tree, "tenant1")); got != "[tenant10:a tenant1:a tenant1:b]" {
+		t.Errorf("unexpected walk result %s", got)
+	}
+
+	if got := fmt.Sprint(walk(tree, "tena")); got != "[tenant10:a tenant1:a tenant1:b tenant2:a]" {
+		t.Errorf("unexpected walk result %s", got)
+	}
+
+	if !tree.Delete("tenant1:a") || tree.Delete("tenant1:a") || tree.Delete("tenant") {
+		t.Errorf("unexpected delete result")
+	}
+
+	if got := fmt.Sprint(walk(tree, "tenant1")); got != "[tenant10:a tenant1:b]" {
+		t.Errorf("unexpected walk result %s", got)
+	}
+
+	if tree.Len() != 5 {
+		t.Errorf("expected 5 keys, got %d", tree.Len())
+	}
+}
+
+func Test_radix_random(t *testing.T) {
+	tree := New()
+	keys := make(map[string]bool)
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("%x", rand.Intn(4096))
+		if rand.Intn(3) == 0 {
+			if tree.Delete(key) != keys[key] {
+				t.Fatalf("unexpected delete result for \"%s\"", key)
+			}
+			delete(keys, key)
+		} else {
+			if tree.Insert(key) == keys[key] {
+				t.Fatalf("unexpected insert result for \"%s\"", key)
+			}
+			keys[key] = true
+		}
+	}
+
+	for _, prefix := range []string{"", "a", "1f", "ff"} {
+		var expected []string
+		for key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				expected = append(expected, key)
+			}
+		}
+		sort.Strings(expected)
+
+		if got := walk(tree, prefix); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("prefix \"%s\": expected %d keys, got %d", prefix, len(expected), len(got))
+		}
+	}
+}
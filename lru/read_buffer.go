@@ -0,0 +1,132 @@
+package lru
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// readBufferStripeSize is the number of accesses a single stripe can hold. Must be a power of two
+	readBufferStripeSize = 64
+	// readBufferAttempts is the number of stripes tried before a contended access is dropped
+	readBufferAttempts = 3
+)
+
+// readBuffer collects accesses made under a shared lock, so the policy can be updated later
+// in batches under the exclusive lock. Accesses are spread over several stripes to reduce contention.
+// The buffer is lossy: when a stripe is full or contended, accesses are dropped.
+// It only affects the precision of the policy.
+type readBuffer struct {
+	stripes []readBufferStripe
+	apply   func(it *item)
+
+	// drainRequired is set when some stripe is half full
+	drainRequired int32
+}
+
+// readBufferStripe is a bounded ring. Readers reserve slots by advancing tail,
+// the drain advances head under the exclusive lock, when no readers are running
+type readBufferStripe struct {
+	head  uint64
+	tail  uint64
+	slots [readBufferStripeSize]unsafe.Pointer
+
+	// keep stripes on separate cache lines
+	_ [64]byte
+}
+
+func newReadBuffer(apply func(it *item)) *readBuffer {
+	return &readBuffer{
+		stripes: make([]readBufferStripe, 4*runtime.GOMAXPROCS(0)),
+		apply:   apply,
+	}
+}
+
+// readBufferProbe picks stripes for the caller. Probes are kept per P by the pool,
+// so concurrent readers of the same hot item write to different stripes
+type readBufferProbe struct {
+	x uint32
+}
+
+// readBufferSeed seeds new probes, so they pick different stripes
+var readBufferSeed uint32
+
+var readBufferProbes = sync.Pool{
+	New: func() interface{} {
+		return &readBufferProbe{x: atomic.AddUint32(&readBufferSeed, 0x9e3779b9) | 1}
+	},
+}
+
+// next returns the next pseudo-random number of the xorshift sequence
+func (p *readBufferProbe) next() uint32 {
+	p.x ^= p.x << 13
+	p.x ^= p.x >> 17
+	p.x ^= p.x << 5
+
+	return p.x
+}
+
+// record saves the access to the item. Safe for concurrent use under the shared lock
+func (b *readBuffer) record(it *item) {
+	probe := readBufferProbes.Get().(*readBufferProbe)
+
+	// a contended stripe is retried on another one, like Caffeine rehashes its probe
+	for attempt := 0; attempt < readBufferAttempts; attempt++ {
+		if b.offer(&b.stripes[probe.next()%uint32(len(b.stripes))], it) {
+			break
+		}
+	}
+
+	readBufferProbes.Put(probe)
+}
+
+// offer appends the access to the stripe. A full stripe drops it. Returns false if the stripe is contended
+func (b *readBuffer) offer(s *readBufferStripe, it *item) bool {
+	head := atomic.LoadUint64(&s.head)
+	tail := atomic.LoadUint64(&s.tail)
+
+	size := tail - head
+	if size >= readBufferStripeSize {
+		atomic.StoreInt32(&b.drainRequired, 1)
+		return true
+	}
+
+	if !atomic.CompareAndSwapUint64(&s.tail, tail, tail+1) {
+		return false
+	}
+
+	atomic.StorePointer(&s.slots[tail&(readBufferStripeSize-1)], unsafe.Pointer(it))
+
+	if size+1 >= readBufferStripeSize/2 {
+		atomic.StoreInt32(&b.drainRequired, 1)
+	}
+
+	return true
+}
+
+// acquireDrain returns true when the buffer must be drained. Only one of concurrent callers gets true
+func (b *readBuffer) acquireDrain() bool {
+	return atomic.LoadInt32(&b.drainRequired) == 1 && atomic.CompareAndSwapInt32(&b.drainRequired, 1, 0)
+}
+
+// drain applies recorded accesses. Must be called under the exclusive lock
+func (b *readBuffer) drain() {
+	atomic.StoreInt32(&b.drainRequired, 0)
+
+	for i := range b.stripes {
+		s := &b.stripes[i]
+
+		head := atomic.LoadUint64(&s.head)
+		tail := atomic.LoadUint64(&s.tail)
+		for ; head < tail; head++ {
+			slot := &s.slots[head&(readBufferStripeSize-1)]
+			if p := atomic.SwapPointer(slot, nil); p != nil {
+				b.apply((*item)(p))
+			}
+		}
+
+		atomic.StoreUint64(&s.head, head)
+	}
+}
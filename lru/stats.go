@@ -0,0 +1,95 @@
+package lru
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of cache statistics.
+// Hits and misses are counted by Get, GetMany, GetOrSet, Compute and GetOrLoad.
+// Deletes are counted by the methods calling the delete hook
+type Stats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Sets          uint64 `json:"sets"`
+	Deletes       uint64 `json:"deletes"`
+	Evictions     uint64 `json:"evictions"`
+	Expirations   uint64 `json:"expirations"`
+	LoadSuccesses uint64 `json:"load_successes"`
+	LoadFailures  uint64 `json:"load_failures"`
+	Size          int    `json:"size"`
+}
+
+// HitRatio returns the share of hits among lookups. Returns zero when there were no lookups
+func (s Stats) HitRatio() float64 {
+	lookups := s.Hits + s.Misses
+	if lookups == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(lookups)
+}
+
+// StatsDelta returns the difference between two snapshots of the same cache.
+// Counters are subtracted, Size is taken from cur
+func StatsDelta(prev Stats, cur Stats) Stats {
+	return Stats{
+		Hits:          cur.Hits - prev.Hits,
+		Misses:        cur.Misses - prev.Misses,
+		Sets:          cur.Sets - prev.Sets,
+		Deletes:       cur.Deletes - prev.Deletes,
+		Evictions:     cur.Evictions - prev.Evictions,
+		Expirations:   cur.Expirations - prev.Expirations,
+		LoadSuccesses: cur.LoadSuccesses - prev.LoadSuccesses,
+		LoadFailures:  cur.LoadFailures - prev.LoadFailures,
+		Size:          cur.Size,
+	}
+}
+
+// StatsVar returns expvar variable reporting statistics of the cache, e.g.
+// expvar.Publish("users_cache", lru.StatsVar(cache))
+func StatsVar(cache Cache) expvar.Var {
+	return expvar.Func(func() interface{} {
+		return cache.Stats()
+	})
+}
+
+// counters are updated atomically, so they can be updated under a shared lock and read at any time
+type counters struct {
+	hits          uint64
+	misses        uint64
+	sets          uint64
+	deletes       uint64
+	evictions     uint64
+	expirations   uint64
+	loadSuccesses uint64
+	loadFailures  uint64
+}
+
+func (c *counters) addLookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *counters) add(counter *uint64, delta int) {
+	if delta > 0 {
+		atomic.AddUint64(counter, uint64(delta))
+	}
+}
+
+func (c *counters) snapshot(size int) Stats {
+	return Stats{
+		Hits:          atomic.LoadUint64(&c.hits),
+		Misses:        atomic.LoadUint64(&c.misses),
+		Sets:          atomic.LoadUint64(&c.sets),
+		Deletes:       atomic.LoadUint64(&c.deletes),
+		Evictions:     atomic.LoadUint64(&c.evictions),
+		Expirations:   atomic.LoadUint64(&c.expirations),
+		LoadSuccesses: atomic.LoadUint64(&c.loadSuccesses),
+		LoadFailures:  atomic.LoadUint64(&c.loadFailures),
+		Size:          size,
+	}
+}
@@ -0,0 +1,81 @@
+package lru
+
+import (
+	"sync/atomic"
+)
+
+// tagIndex maps tags to the keys they are attached to
+type tagIndex struct {
+	keys map[string]map[string]struct{}
+
+	// sizes are stored atomically to be read by metrics without locking
+	tagsLen    int64
+	entriesLen int64
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{keys: make(map[string]map[string]struct{})}
+}
+
+func (t *tagIndex) add(key string, tags []string) {
+	for _, tag := range tags {
+		keys, found := t.keys[tag]
+		if !found {
+			keys = make(map[string]struct{})
+			t.keys[tag] = keys
+			atomic.AddInt64(&t.tagsLen, 1)
+		}
+
+		if _, found := keys[key]; !found {
+			keys[key] = struct{}{}
+			atomic.AddInt64(&t.entriesLen, 1)
+		}
+	}
+}
+
+func (t *tagIndex) remove(key string, tags []string) {
+	for _, tag := range tags {
+		keys, found := t.keys[tag]
+		if !found {
+			continue
+		}
+
+		if _, found := keys[key]; found {
+			delete(keys, key)
+			atomic.AddInt64(&t.entriesLen, -1)
+		}
+
+		if len(keys) == 0 {
+			delete(t.keys, tag)
+			atomic.AddInt64(&t.tagsLen, -1)
+		}
+	}
+}
+
+// keysOf returns a copy of the keys tagged with the tag
+func (t *tagIndex) keysOf(tag string) []string {
+	keys := t.keys[tag]
+
+	ret := make([]string, 0, len(keys))
+	for key := range keys {
+		ret = append(ret, key)
+	}
+
+	return ret
+}
+
+func (t *tagIndex) reset() {
+	t.keys = make(map[string]map[string]struct{})
+	atomic.StoreInt64(&t.tagsLen, 0)
+	atomic.StoreInt64(&t.entriesLen, 0)
+}
+
+// TagsLen returns the number of distinct tags
+func (t *tagIndex) TagsLen() int {
+	return int(atomic.LoadInt64(&t.tagsLen))
+}
+
+// EntriesLen returns the number of key-tag pairs
+func (t *tagIndex) EntriesLen() int {
+	return int(atomic.LoadInt64(&t.entriesLen))
+}
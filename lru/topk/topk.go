@@ -0,0 +1,131 @@
+package topk
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// Tracker finds the most frequent keys with the space-saving algorithm using a fixed number of counters.
+// When all counters are taken, a new key replaces the least frequent one and inherits its count,
+// so counts are overestimated by at most Error. Keys occurring more than 1/capacity of the time are always tracked.
+// Tracker is safe for concurrent use
+type Tracker struct {
+	mu       sync.Mutex
+	capacity int
+	index    map[string]*counter
+	heap     counterHeap
+}
+
+// Item is a tracked key. Count is an estimate, the real number of occurrences is in range [Count-Error, Count]
+type Item struct {
+	Key   string
+	Count uint64
+	Error uint64
+}
+
+type counter struct {
+	Item
+	position int
+}
+
+func New(capacity int) *Tracker {
+	if capacity <= 0 {
+		panic("capacity must be greater than zero")
+	}
+
+	return &Tracker{
+		capacity: capacity,
+		index:    make(map[string]*counter, capacity),
+		heap:     make(counterHeap, 0, capacity),
+	}
+}
+
+// Add counts an occurrence of the key
+func (t *Tracker) Add(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, found := t.index[key]; found {
+		c.Count++
+		heap.Fix(&t.heap, c.position)
+		return
+	}
+
+	if len(t.heap) < t.capacity {
+		c := &counter{Item: Item{Key: key, Count: 1}}
+		t.index[key] = c
+		heap.Push(&t.heap, c)
+		return
+	}
+
+	// replace the least frequent key
+	c := t.heap[0]
+	delete(t.index, c.Key)
+
+	c.Key = key
+	c.Error = c.Count
+	c.Count++
+	t.index[key] = c
+	heap.Fix(&t.heap, 0)
+}
+
+// Top returns up to n most frequent keys, most frequent first
+func (t *Tracker) Top(n int) []Item {
+	t.mu.Lock()
+	ret := make([]Item, 0, len(t.heap))
+	for _, c := range t.heap {
+		ret = append(ret, c.Item)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Key < ret[j].Key
+	})
+
+	if n < 0 {
+		n = 0
+	}
+
+	if n < len(ret) {
+		ret = ret[:n]
+	}
+
+	return ret
+}
+
+// Reset forgets all keys
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	t.index = make(map[string]*counter, t.capacity)
+	t.heap = t.heap[:0]
+	t.mu.Unlock()
+}
+
+// counterHeap is a min-heap of counters by count
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].position = i
+	h[j].position = j
+}
+
+func (h *counterHeap) Push(x interface{}) {
+	c := x.(*counter)
+	c.position = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
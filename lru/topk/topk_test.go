@@ -0,0 +1,58 @@
+package topk
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func Test_topk_exact(t *testing.T) {
+	tracker := New(3)
+	for i, n := range []int{5, 3, 1} {
+		for j := 0; j < n; j++ {
+			tracker.Add(fmt.Sprintf("key-%d", i))
+		}
+	}
+
+	top := tracker.Top(2)
+	expected := []Item{{Key: "key-0", Count: 5}, {Key: "key-1", Count: 3}}
+	if len(top) != len(expected) {
+		t.Fatalf("expected %d items, got %d", len(expected), len(top))
+	}
+
+	for i := range expected {
+		if top[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], top[i])
+		}
+	}
+}
+
+func Test_topk_heavy_hitters(t *testing.T) {
+	tracker := New(20)
+	real := make(map[string]uint64)
+
+	rnd := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rnd, 1.5, 1, 10000)
+	for i := 0; i < 100000; i++ {
+		key := fmt.Sprintf("key-%d", zipf.Uint64())
+		real[key]++
+		tracker.Add(key)
+	}
+
+	top := tracker.Top(5)
+	for i, item := range top {
+		// zipf ranks match key numbers
+		if item.Key != fmt.Sprintf("key-%d", i) {
+			t.Errorf("expected key-%d at rank %d, got %s", i, i, item.Key)
+		}
+
+		if real[item.Key] > item.Count || real[item.Key] < item.Count-item.Error {
+			t.Errorf("real count %d of %s is out of [%d, %d]", real[item.Key], item.Key, item.Count-item.Error, item.Count)
+		}
+	}
+
+	tracker.Reset()
+	if len(tracker.Top(5)) != 0 {
+		t.Error("expected no keys after reset")
+	}
+}
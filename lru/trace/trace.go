@@ -0,0 +1,227 @@
+// Package trace implements a compact binary format of cache access traces.
+//
+// A trace starts with a header: 4 bytes of magic "LRUT" followed by a version byte.
+// Each record takes 18 bytes:
+//   - 8 bytes: unix time in nanoseconds, big endian;
+//   - 1 byte: operation;
+//   - 1 byte: flags, bit 0 is set on hit;
+//   - 8 bytes: FNV-1a hash of the key, big endian.
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Op uint8
+
+const (
+	OpGet Op = iota + 1
+	OpSet
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpGet:
+		return "get"
+	case OpSet:
+		return "set"
+	case OpDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Record is a single cache operation
+type Record struct {
+	Time    time.Time
+	Op      Op
+	KeyHash uint64
+	// Hit is true when Get found the key, Set replaced an existing key or Delete deleted the key
+	Hit bool
+}
+
+const (
+	magic      = "LRUT"
+	version    = 1
+	headerSize = len(magic) + 1
+	recordSize = 18
+
+	flagHit = 1
+)
+
+// HashKey returns FNV-1a hash of the key. Keys are never written to traces as is
+func HashKey(key string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+
+	hash := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= prime64
+	}
+
+	return hash
+}
+
+func encodeRecord(buf []byte, r Record) {
+	binary.BigEndian.PutUint64(buf[0:8], uint64(r.Time.UnixNano()))
+	buf[8] = byte(r.Op)
+	buf[9] = 0
+	if r.Hit {
+		buf[9] |= flagHit
+	}
+	binary.BigEndian.PutUint64(buf[10:18], r.KeyHash)
+}
+
+func decodeRecord(buf []byte) Record {
+	return Record{
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(buf[0:8]))),
+		Op:      Op(buf[8]),
+		Hit:     buf[9]&flagHit != 0,
+		KeyHash: binary.BigEndian.Uint64(buf[10:18]),
+	}
+}
+
+// Writer writes records in background. Writes never block: when the buffer is full, records are dropped
+type Writer struct {
+	records chan Record
+	dropped uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// NewWriter creates a writer that buffers up to bufferSize records
+func NewWriter(w io.Writer, bufferSize int) *Writer {
+	ret := &Writer{
+		records: make(chan Record, bufferSize),
+		done:    make(chan struct{}),
+	}
+
+	go ret.run(bufio.NewWriter(w))
+
+	return ret
+}
+
+// Write puts the record into the buffer. Returns false if the record was dropped
+func (w *Writer) Write(r Record) bool {
+	select {
+	case w.records <- r:
+		return true
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+		return false
+	}
+}
+
+// Dropped returns the number of records dropped because of full buffer
+func (w *Writer) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Close writes buffered records and stops the writer. Write must not be called after Close
+func (w *Writer) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.records)
+	})
+	<-w.done
+
+	return w.err
+}
+
+func (w *Writer) run(bw *bufio.Writer) {
+	defer close(w.done)
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = version
+
+	_, w.err = bw.Write(header)
+
+	buf := make([]byte, recordSize)
+	for r := range w.records {
+		// keep draining the channel after an error, so writers are never blocked
+		if w.err != nil {
+			continue
+		}
+
+		encodeRecord(buf, r)
+		_, w.err = bw.Write(buf)
+
+		// flush when there is nothing more to write right now
+		if w.err == nil && len(w.records) == 0 {
+			w.err = bw.Flush()
+		}
+	}
+
+	if w.err == nil {
+		w.err = bw.Flush()
+	}
+}
+
+// Reader decodes records
+type Reader struct {
+	r      *bufio.Reader
+	header bool
+	buf    []byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:   bufio.NewReader(r),
+		buf: make([]byte, recordSize),
+	}
+}
+
+// Read returns the next record. Returns io.EOF when there are no more records
+func (r *Reader) Read() (Record, error) {
+	if !r.header {
+		if err := r.readHeader(); err != nil {
+			return Record{}, err
+		}
+		r.header = true
+	}
+
+	_, err := io.ReadFull(r.r, r.buf)
+	if err == io.ErrUnexpectedEOF {
+		return Record{}, errors.New("truncated record")
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	return decodeRecord(r.buf), nil
+}
+
+func (r *Reader) readHeader() error {
+	header := make([]byte, headerSize)
+
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("missing trace header")
+		}
+		return err
+	}
+
+	if string(header[:len(magic)]) != magic {
+		return errors.New("not a trace")
+	}
+
+	if header[len(magic)] != version {
+		return errors.Errorf("unsupported trace version %d", header[len(magic)])
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package trace
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func Test_trace_roundtrip(t *testing.T) {
+	records := []Record{
+		{Time: time.Unix(0, 1), Op: OpSet, KeyHash: HashKey("a"), Hit: false},
+		{Time: time.Unix(100, 42), Op: OpGet, KeyHash: HashKey("a"), Hit: true},
+		{Time: time.Unix(200, 0), Op: OpDelete, KeyHash: HashKey("b"), Hit: false},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, len(records))
+	for i := range records {
+		if !w.Write(records[i]) {
+			t.Fatalf("record %d dropped", i)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	r := NewReader(&buf)
+	for i := range records {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("read %d: %s", i, err)
+		}
+		if !got.Time.Equal(records[i].Time) || got.Op != records[i].Op ||
+			got.KeyHash != records[i].KeyHash || got.Hit != records[i].Hit {
+			t.Errorf("expected %+v, got %+v", records[i], got)
+		}
+	}
+
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func Test_trace_bad_header(t *testing.T) {
+	if _, err := NewReader(bytes.NewBufferString("garbage")).Read(); err == nil {
+		t.Errorf("expected error")
+	}
+}